@@ -0,0 +1,118 @@
+package chunk
+
+import (
+	"sync"
+	"time"
+)
+
+// Usage - what a tenant holds, see Limits
+type Usage struct {
+	// Sessions - open sessions by chunk folder
+	Sessions map[string]SessionUsage
+	// StoredBytes - bytes of assembled files
+	StoredBytes int64
+}
+
+// SessionUsage - an open session, reserving Size bytes
+type SessionUsage struct {
+	Size    int64
+	Started time.Time
+}
+
+func (u *Usage) reserved() int64 {
+	var reserved int64
+	for _, s := range u.Sessions {
+		reserved += s.Size
+	}
+	return reserved
+}
+
+// Accounting - stores the Usage of every tenant
+type Accounting interface {
+	// Update - change the usage of tenant atomically, nothing is changed if fn returns an error
+	Update(tenant string, fn func(u *Usage) error) error
+}
+
+// MemoryAccounting - an Accounting that is lost on restart
+type MemoryAccounting struct {
+	mu    sync.Mutex
+	usage map[string]*Usage
+}
+
+func (m *MemoryAccounting) Update(tenant string, fn func(u *Usage) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usage == nil {
+		m.usage = make(map[string]*Usage)
+	}
+
+	usage := copyUsage(m.usage[tenant])
+	if err := fn(usage); err != nil {
+		return err
+	}
+	m.usage[tenant] = usage
+	return nil
+}
+
+// FileAccounting - an Accounting kept in a JSON file at Path, rewritten atomically on every change
+type FileAccounting struct {
+	Path string
+
+	mu    sync.Mutex
+	usage map[string]*Usage
+}
+
+func (f *FileAccounting) Update(tenant string, fn func(u *Usage) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	previous := f.usage[tenant]
+	usage := copyUsage(previous)
+	if err := fn(usage); err != nil {
+		return err
+	}
+
+	f.usage[tenant] = usage
+	if err := f.save(); err != nil {
+		f.usage[tenant] = previous
+		return err
+	}
+	return nil
+}
+
+// load - read the file once, called with mu held
+func (f *FileAccounting) load() error {
+	if f.usage != nil {
+		return nil
+	}
+
+	usage := make(map[string]*Usage)
+	if err := f.file().load(&usage); err != nil {
+		return err
+	}
+	f.usage = usage
+	return nil
+}
+
+// save - replace the accounting file, called with mu held
+func (f *FileAccounting) save() error {
+	return f.file().save(f.usage)
+}
+
+func (f *FileAccounting) file() jsonFile {
+	return jsonFile{path: f.Path, what: "accounting"}
+}
+
+func copyUsage(u *Usage) *Usage {
+	c := &Usage{Sessions: make(map[string]SessionUsage)}
+	if u != nil {
+		c.StoredBytes = u.StoredBytes
+		for k, s := range u.Sessions {
+			c.Sessions[k] = s
+		}
+	}
+	return c
+}
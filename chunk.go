@@ -2,8 +2,10 @@ package chunk
 
 import (
 	"io"
+	"net/url"
 	"os"
 	"strconv"
+	"time"
 )
 
 const uploadFolder = "incomplete"
@@ -11,14 +13,27 @@ const bufferSize = 1024*1024 + 4096 //1MB for the file being uploaded, 4096 for
 const maxFileKeySize = 256
 const assemblerCount = 2
 const delim = "_"
+const progressInterval = time.Second
+const maxResolveDepth = 8
+const assemblyHistory = 1000
 
 // folder to assemble
 type ChunkFolder struct {
 	FolderSource
 
+	//Identifier - the upload session, used to cancel an assembly
+	Identifier string
+	//Tenant - the user or tenant owning the session, empty when uploads are not namespaced
+	Tenant string
+
 	//final final name
 	Filename string
 
+	//OriginalFilename - flowFilename, the name of the file on the client
+	OriginalFilename string
+	//RelativePath - flowRelativePath, the path of the file on the client
+	RelativePath string
+
 	isComplete bool
 }
 
@@ -26,28 +41,78 @@ func (f *ChunkFolder) IsComplete() bool {
 	return f.isComplete
 }
 
+// key - the session as known to the FileAssembler, see SessionKey
+func (f *ChunkFolder) key() string {
+	return SessionKey(f.Tenant, f.Identifier)
+}
+
 type UploadOutcome struct {
 	Uri  string
 	Err  error
 	Data interface{}
+
+	//Size - bytes in the assembled file
+	Size int64
+	//Digest - hex encoded sha256 of the assembled file
+	Digest string
+	//Filename - the original filename on the client
+	Filename string
+	//ContentType - detected from the first bytes of the file
+	ContentType string
+	//Replicas - every copy written when the destination writer is a ReplicaReporter such as MultiDestination
+	Replicas []Replica
+	//Deduplicated - the content was already stored, Uri is the existing copy and nothing was written
+	Deduplicated bool
+	//Metadata - added by the processors of FileAssembler.Pipeline
+	Metadata map[string]interface{}
+	//Derived - files written by the processors
+	Derived []Derived
+	//StageErrors - processors that failed without failing the upload, see ErrorContinue
+	StageErrors []*StageError
 }
 
 type AssembleFolder struct {
-	Callback    func(*UploadOutcome)
+	Callback func(*UploadOutcome)
+	//Progress - optional, called periodically while the chunks are copied
+	Progress    func(*AssemblyProgress)
 	Data        interface{}
 	Source      *ChunkFolder
 	Destination FolderDestination
-	uri         string
-	err         error
+	//Naming - how the assembled file is named, defaults to the identifier
+	Naming       Naming
+	uri          string
+	err          error
+	cancel       *cancellation
+	size         int64
+	digest       string
+	contentType  string
+	replicas     []Replica
+	deduplicated bool
+	metadata     map[string]interface{}
+	derived      []Derived
+	stageErrors  []*StageError
 }
 
 func (o *AssembleFolder) Notify() {
 	if c := o.Callback; c != nil {
-		c(&UploadOutcome{
-			Uri:  o.uri,
-			Err:  o.err,
-			Data: o.Data,
-		})
+		c(o.outcome())
+	}
+}
+
+func (o *AssembleFolder) outcome() *UploadOutcome {
+	return &UploadOutcome{
+		Uri:          o.uri,
+		Err:          o.err,
+		Data:         o.Data,
+		Size:         o.size,
+		Digest:       o.digest,
+		Filename:     o.Source.OriginalFilename,
+		ContentType:  o.contentType,
+		Replicas:     o.replicas,
+		Deduplicated: o.deduplicated,
+		Metadata:     o.metadata,
+		Derived:      o.derived,
+		StageErrors:  o.stageErrors,
 	}
 }
 
@@ -74,6 +139,96 @@ type FolderDestination interface {
 	Size(filename string) int64
 }
 
+// Aborter - implemented by writers that can drop a partial file instead of committing it on Close
+type Aborter interface {
+	Abort() error
+}
+
+// Discard - abandon a partial file, true if the writer aborted it and nothing needs deleting
+func Discard(w io.WriteCloser) bool {
+	if a, ok := w.(Aborter); ok && a.Abort() == nil {
+		return true
+	}
+	w.Close()
+	return false
+}
+
+// LeftBehind - after Close of w failed, true if a partial file may be left under its name. An Aborter drops
+// its own, deleting the name then would remove the file committed there before.
+func LeftBehind(w io.WriteCloser) bool {
+	return !canAbort(w)
+}
+
+// abortable - implemented by writers that wrap another one, they can abort only if the wrapped writer can
+type abortable interface {
+	canAbort() bool
+}
+
+// canAbort - true if Abort of w drops its partial file
+func canAbort(w io.WriteCloser) bool {
+	if a, ok := w.(abortable); ok {
+		return a.canAbort()
+	}
+	_, ok := w.(Aborter)
+	return ok
+}
+
+// ExclusiveCreator - implemented by folder destinations that can create a file only if it does not exist yet.
+// Close of the writer fails with ErrFileExists when another writer committed the file first.
+type ExclusiveCreator interface {
+	CreateExclusive(filename string) (io.WriteCloser, error)
+}
+
+// createExclusive - create filename in d, exclusively when d supports it
+func createExclusive(d FolderDestination, filename string) (io.WriteCloser, error) {
+	if x, ok := d.(ExclusiveCreator); ok {
+		return x.CreateExclusive(filename)
+	}
+	return d.Create(filename)
+}
+
+// FileOpener - implemented by folder destinations that can read back what they wrote
+type FileOpener interface {
+	Open(filename string) (io.ReadCloser, error)
+}
+
+// Renamer - implemented by folder destinations that can give a file another name, replacing a file
+// already there. The assembler writes files under a staging name and publishes them once the pipeline passed.
+type Renamer interface {
+	Rename(from, to string) error
+}
+
+// canRename - true if d can Rename, the folder wrappers only when what they wrap can
+func canRename(d FolderDestination) bool {
+	switch w := d.(type) {
+	case *EncryptedFolder:
+		return canRename(w.Destination)
+	case *CompressedFolder:
+		return canRename(w.Destination)
+	}
+	_, ok := d.(Renamer)
+	return ok
+}
+
+// ExclusiveRenamer - implemented by folder destinations that can give a file a name only if it is not taken,
+// failing with ErrFileExists otherwise. The assembler publishes files with it unless the collision policy is
+// CollisionOverwrite, so two uploads cannot claim the same name.
+type ExclusiveRenamer interface {
+	RenameExclusive(from, to string) error
+}
+
+// canRenameExclusive - true if d can RenameExclusive, the folder wrappers only when what they wrap can
+func canRenameExclusive(d FolderDestination) bool {
+	switch w := d.(type) {
+	case *EncryptedFolder:
+		return canRenameExclusive(w.Destination)
+	case *CompressedFolder:
+		return canRenameExclusive(w.Destination)
+	}
+	_, ok := d.(ExclusiveRenamer)
+	return ok
+}
+
 type Destination interface {
 	Writer(subfolder string) FolderDestination
 	Reader(subfolder string) FolderSource
@@ -88,3 +243,22 @@ func (a ByChunk) Less(i, j int) bool {
 	aj, _ := strconv.Atoi(a[j].Name())
 	return ai < aj
 }
+
+// SessionKey - the chunk folder and assembler key of a session, "tenant/identifier" for a tenant
+func SessionKey(tenant, identifier string) string {
+	if tenant == "" {
+		return identifier
+	}
+	return escapeTenant(tenant) + "/" + identifier
+}
+
+// escapeTenant - tenant as a single safe path element, different tenants never share one
+func escapeTenant(tenant string) string {
+	switch tenant {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	return url.PathEscape(tenant)
+}
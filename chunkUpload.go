@@ -3,6 +3,7 @@ package chunk
 import (
 	"io"
 	"strconv"
+	"time"
 
 	"github.com/gotgo/fw/me"
 )
@@ -19,10 +20,18 @@ type ChunkUpload struct {
 	RelativePath       string
 	TotalChunks        int
 	Destination        Destination
+	//Tenant - optional, namespaces Identifier so it only has to be unique per user or tenant
+	Tenant string
+	//Observer - optional, notified of session start, received, rejected and completed chunks
+	Observer Observer
+	//Limits - optional, size caps checked on every chunk and tenant quotas when the session starts
+	Limits *Limits
+	//FileTypes - optional, the content types the first chunk may have
+	FileTypes *FileTypes
 }
 
 func (u *ChunkUpload) chunkFolderName() string {
-	return u.Identifier
+	return SessionKey(u.Tenant, u.Identifier)
 }
 
 func (u *ChunkUpload) filename() string {
@@ -36,31 +45,77 @@ func (u *ChunkUpload) ChunkAlreadyUploaded() bool {
 }
 
 func (u *ChunkUpload) UploadChunk(src io.Reader) (*ChunkFolder, error) {
+	observer := observerOrNop(u.Observer)
+	started := time.Now()
+
+	folder, copied, err := u.storeChunk(src, observer)
+	if err != nil {
+		observer.ChunkRejected(u, err)
+		return nil, err
+	}
+
+	observer.ChunkReceived(u, copied, time.Since(started))
+	if folder.IsComplete() {
+		observer.SessionComplete(u, folder)
+	}
+	return folder, nil
+}
+
+func (u *ChunkUpload) storeChunk(src io.Reader, observer Observer) (*ChunkFolder, int64, error) {
 	d := u.Destination.Writer(u.chunkFolderName())
+
+	err := u.Limits.check(u)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var contentType string
+	if u.CurrentChunkNumber == 1 {
+		if contentType, src, err = u.detectType(src); err != nil {
+			if rejected, ok := err.(*FileTypeError); ok {
+				_ = u.rejectSession(d, rejected) //nothing of it is wanted, whichever chunk came first
+			}
+			return nil, 0, err
+		}
+	}
+
+	sessionStarted, err := u.startSession(d, contentType)
+	if err != nil {
+		return nil, 0, err
+	}
+	if sessionStarted {
+		observer.SessionStarted(u)
+	}
+
 	dstPath := u.filename()
 	dst, err := d.Create(dstPath)
 	if err != nil {
-		return nil, me.Err(err, "failed to create file for chunk")
+		return nil, 0, me.Err(err, "failed to create file for chunk")
 	}
 
 	var copied int64
-	if copied, err = io.Copy(dst, src); err != nil {
-		_ = dst.Close()
-		_ = d.Delete(dstPath) //remove tainted file
-		return nil, me.Err(err, "failed to copy source file to destinationfile", &me.KV{"dest", dst}, &me.KV{"source", "http multi part"})
+	//one byte more than advertised is enough to tell the chunk is too large
+	if copied, err = io.Copy(dst, io.LimitReader(src, int64(u.CurrentChunkSize)+1)); err != nil {
+		if !Discard(dst) {
+			_ = d.Delete(dstPath) //remove tainted file
+		}
+		return nil, 0, me.Err(err, "failed to copy source file to destinationfile", &me.KV{"dest", dst}, &me.KV{"source", "http multi part"})
 	}
 
 	if copied != int64(u.CurrentChunkSize) {
-		_ = dst.Close()
-		_ = d.Delete(dstPath)
-		return nil, me.NewErr("actual chunk size not the same as the advertised CurrentChunkSize",
+		if !Discard(dst) {
+			_ = d.Delete(dstPath)
+		}
+		return nil, 0, me.NewErr("actual chunk size not the same as the advertised CurrentChunkSize",
 			&me.KV{"CurrentChunkSize", u.CurrentChunkSize},
 			&me.KV{"copied", copied})
 	}
 
 	if err = dst.Close(); err != nil {
-		_ = d.Delete(dstPath) //remove possibly tainted file
-		return nil, me.Err(err, "failed to close destination")
+		if LeftBehind(dst) {
+			_ = d.Delete(dstPath) //remove possibly tainted file
+		}
+		return nil, 0, me.Err(err, "failed to close destination")
 	}
 
 	//sum of uploaded files
@@ -68,19 +123,32 @@ func (u *ChunkUpload) UploadChunk(src io.Reader) (*ChunkFolder, error) {
 	s := u.Destination.Reader(u.chunkFolderName())
 	sum, err := sumSizes(s.Files()) //sizes
 	if err != nil {
-		return nil, me.Err(err, "unable to get list of uploaded chunk files", &me.KV{"path", dstPath})
+		return nil, 0, me.Err(err, "unable to get list of uploaded chunk files", &me.KV{"path", dstPath})
 	}
 
 	filename := u.chunkFolderName()
 	folder := &ChunkFolder{
-		Filename: filename,
+		Identifier:       u.Identifier,
+		Tenant:           u.Tenant,
+		Filename:         filename,
+		OriginalFilename: u.Filename,
+		RelativePath:     u.RelativePath,
 	}
 
 	folder.FolderSource = s
 	if sum == u.TotalSize {
 		folder.isComplete = true
 	}
-	return folder, nil
+	return folder, copied, nil
+}
+
+// Abort - discard all chunks uploaded so far for this session
+func (u *ChunkUpload) Abort() error {
+	s := u.Destination.Reader(u.chunkFolderName())
+	if err := s.Remove(); err != nil {
+		return me.Err(err, "failed to remove chunk folder", &me.KV{"identifier", u.Identifier})
+	}
+	return u.Limits.close(u.Tenant, u.chunkFolderName(), 0)
 }
 
 // sumSizes - given a list of file infos, what is the sum of the file size across all files
@@ -2,6 +2,13 @@ package chunk_test
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	. "github.com/gotgo/chunk"
 
@@ -84,6 +91,31 @@ func (s *MockSource) Read(p []byte) (n int, err error) {
 	}
 }
 
+type CountingObserver struct {
+	NopObserver
+	received, rejected, completed int
+}
+
+func (o *CountingObserver) ChunkReceived(u *ChunkUpload, size int64, elapsed time.Duration) {
+	o.received++
+}
+func (o *CountingObserver) ChunkRejected(u *ChunkUpload, reason error) {
+	o.rejected++
+}
+func (o *CountingObserver) SessionComplete(u *ChunkUpload, folder *ChunkFolder) {
+	o.completed++
+}
+
+// StartCounter - counts started sessions, safe for concurrent uploads
+type StartCounter struct {
+	NopObserver
+	started int32
+}
+
+func (o *StartCounter) SessionStarted(u *ChunkUpload) {
+	atomic.AddInt32(&o.started, 1)
+}
+
 var _ = Describe("ChunkUpload", func() {
 
 	It("should work", func() {
@@ -113,4 +145,104 @@ var _ = Describe("ChunkUpload", func() {
 		Expect(folder.IsComplete()).To(BeTrue())
 	})
 
+	It("should notify the observer", func() {
+		observer := &CountingObserver{}
+		c := &ChunkUpload{
+			CurrentChunkNumber: 1,
+			CurrentChunkSize:   512,
+			ChunkSize:          512,
+			TotalSize:          512,
+			TotalChunks:        1,
+			Identifier:         "abcdefg",
+			Destination:        &MockDestination{fileSize: 512},
+			Observer:           observer,
+		}
+
+		_, err := c.UploadChunk(&MockSource{size: 256})
+		Expect(err).ToNot(BeNil())
+
+		_, err = c.UploadChunk(&MockSource{size: 512})
+		Expect(err).To(BeNil())
+
+		Expect(observer.rejected).To(Equal(1))
+		Expect(observer.received).To(Equal(1))
+		Expect(observer.completed).To(Equal(1))
+	})
+
+	It("should report received and missing chunks", func() {
+		folder, _ := ioutil.TempDir("", "status")
+		defer os.RemoveAll(folder)
+
+		d := &FileDestination{FolderRoot: folder}
+		for _, n := range []int{1, 3, 4} {
+			c := &ChunkUpload{CurrentChunkNumber: n, CurrentChunkSize: 10, ChunkSize: 10, TotalSize: 60, TotalChunks: 6, Identifier: "resume", Destination: d}
+			_, err := c.UploadChunk(&MockSource{size: 10})
+			Expect(err).To(BeNil())
+		}
+
+		status, err := (&ChunkUpload{Identifier: "resume", Destination: d}).Status()
+		Expect(err).To(BeNil())
+		Expect(status.Received).To(Equal([]int{1, 3, 4}))
+		Expect(status.Missing).To(Equal([]ChunkRange{{2, 2}, {5, 6}}))
+		Expect(status.ReceivedBytes).To(Equal(int64(30)))
+		Expect(status.Manifest.TotalChunks).To(Equal(6))
+		Expect(status.Complete).To(BeFalse())
+
+		status, err = (&ChunkUpload{Identifier: "unknown", Destination: d}).Status()
+		Expect(err).To(BeNil())
+		Expect(status.Manifest).To(BeNil())
+		Expect(status.Received).To(BeEmpty())
+	})
+
+	It("should keep the sessions of tenants apart", func() {
+		folder, _ := ioutil.TempDir("", "tenants")
+		defer os.RemoveAll(folder)
+
+		d := &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete := &FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+		fa := &FileAssembler{}
+		fa.Start()
+		defer fa.Stop()
+
+		outcomes := make(chan *UploadOutcome, 2)
+		for _, tenant := range []string{"alice", "bob"} {
+			c := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 5, ChunkSize: 5, TotalSize: 5, TotalChunks: 1, Identifier: "5-notes.txt", Filename: "notes.txt", Tenant: tenant, Destination: d}
+			source, err := c.UploadChunk(strings.NewReader(tenant[:2] + "..."))
+			Expect(err).To(BeNil())
+			Expect(source.IsComplete()).To(BeTrue())
+			fa.Post(&AssembleFolder{Source: source, Destination: complete, Naming: Naming{Policy: NameByOriginal}, Callback: func(o *UploadOutcome) { outcomes <- o }})
+			Eventually(outcomes).Should(Receive())
+		}
+
+		for _, tenant := range []string{"alice", "bob"} {
+			b, err := ioutil.ReadFile(filepath.Join(folder, "complete", tenant, "notes.txt"))
+			Expect(err).To(BeNil())
+			Expect(string(b)).To(Equal(tenant[:2] + "..."))
+			Eventually(func() AssemblyState { return fa.Status(SessionKey(tenant, "5-notes.txt")).State }).Should(Equal(AssemblyDone))
+		}
+		Expect(fa.Status("5-notes.txt").State).To(Equal(AssemblyUnknown))
+	})
+
+	It("should start a session once when its chunks arrive together", func() {
+		folder, _ := ioutil.TempDir("", "concurrent")
+		defer os.RemoveAll(folder)
+		d := &FileDestination{FolderRoot: folder}
+		observer := &StartCounter{}
+
+		var wg sync.WaitGroup
+		for i := 1; i <= 8; i++ {
+			wg.Add(1)
+			go func(number int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				c := &ChunkUpload{CurrentChunkNumber: number, CurrentChunkSize: 4, ChunkSize: 4, TotalSize: 32, TotalChunks: 8,
+					Identifier: "parallel", Filename: "parallel.bin", Destination: d, Observer: observer}
+				_, err := c.UploadChunk(strings.NewReader("data"))
+				Expect(err).To(BeNil())
+			}(i)
+		}
+		wg.Wait()
+		Expect(atomic.LoadInt32(&observer.started)).To(Equal(int32(1)))
+	})
+
 })
@@ -0,0 +1,421 @@
+package chunk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gotgo/fw/me"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression - the format of files written by CompressedFolder
+type Compression int
+
+const (
+	CompressGzip Compression = iota
+	CompressZstd
+)
+
+// Every compressed file ends with a fixed size frame that standard tools skip, holding the uncompressed
+// length so Size does not have to decompress the file. For gzip it is an empty member with the length in
+// an extra field, for zstd a skippable frame.
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	sizeFrameId = []byte("CK")
+)
+
+const (
+	gzipSizeAt         = 16
+	gzipSizeFrame      = gzipSizeAt + 8 + 5 + 8
+	zstdSizeAt         = 10
+	zstdSizeFrame      = zstdSizeAt + 8
+	zstdSkippableMagic = 0x184d2a5c
+)
+
+// CompressedDestination - a Destination that compresses chunks as they are stored, see CompressedFolder
+type CompressedDestination struct {
+	Destination Destination
+	Compression Compression
+
+	// sizes - the uncompressed sizes of the chunks read so far, by subfolder, so the sizes of a session are
+	// summed without opening every chunk on every upload
+	sizes sync.Map
+}
+
+func (c *CompressedDestination) Writer(subfolder string) FolderDestination {
+	return &CompressedFolder{Destination: c.Destination.Writer(subfolder), Compression: c.Compression}
+}
+
+func (c *CompressedDestination) Reader(subfolder string) FolderSource {
+	sizes, _ := c.sizes.LoadOrStore(subfolder, &sync.Map{})
+	return &compressedSource{
+		source: c.Destination.Reader(subfolder),
+		sizes:  sizes.(*sync.Map),
+		forget: func() { c.sizes.Delete(subfolder) },
+	}
+}
+
+// CompressedFolder - a FolderDestination that compresses every file. Size reports the uncompressed length
+// when Destination can open the file, otherwise the stored length. Use it as the AssembleFolder.Destination to
+// keep the assembled file compressed, name it with a Template such as "{name}.gz" and read it with
+// DecompressReader or any gzip or zstd tool.
+type CompressedFolder struct {
+	Destination FolderDestination
+	Compression Compression
+}
+
+func (c *CompressedFolder) Create(filename string) (io.WriteCloser, error) {
+	w, err := c.Destination.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(w, filename)
+}
+
+// CreateExclusive - exclusive when Destination is an ExclusiveCreator
+func (c *CompressedFolder) CreateExclusive(filename string) (io.WriteCloser, error) {
+	w, err := createExclusive(c.Destination, filename)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(w, filename)
+}
+
+func (c *CompressedFolder) wrap(w io.WriteCloser, filename string) (io.WriteCloser, error) {
+	var err error
+	cw := &compressWriter{w: w, compression: c.Compression, folder: c.Destination, filename: filename}
+	switch c.Compression {
+	case CompressGzip:
+		cw.encoder = gzip.NewWriter(w)
+	case CompressZstd:
+		if cw.encoder, err = zstd.NewWriter(w, zstd.WithEncoderConcurrency(1)); err != nil {
+			if !Discard(w) {
+				c.Destination.Delete(filename)
+			}
+			return nil, me.Err(err, "failed to create zstd encoder")
+		}
+	default:
+		if !Discard(w) {
+			c.Destination.Delete(filename)
+		}
+		return nil, me.NewErr("unknown compression", &me.KV{"compression", c.Compression})
+	}
+	return cw, nil
+}
+
+// Admit - passed on to Destination
+func (c *CompressedFolder) Admit(size int64) error {
+	if a, ok := c.Destination.(Admitter); ok {
+		return a.Admit(size)
+	}
+	return nil
+}
+
+func (c *CompressedFolder) Delete(filename string) error {
+	return c.Destination.Delete(filename)
+}
+
+func (c *CompressedFolder) Uri(filename string) string {
+	return c.Destination.Uri(filename)
+}
+
+// Rename - when Destination is a Renamer
+func (c *CompressedFolder) Rename(from, to string) error {
+	r, ok := c.Destination.(Renamer)
+	if !ok {
+		return me.NewErr("destination cannot rename files", &me.KV{"from", from})
+	}
+	return r.Rename(from, to)
+}
+
+// RenameExclusive - when Destination is an ExclusiveRenamer
+func (c *CompressedFolder) RenameExclusive(from, to string) error {
+	r, ok := c.Destination.(ExclusiveRenamer)
+	if !ok {
+		return me.NewErr("destination cannot rename files exclusively", &me.KV{"from", from})
+	}
+	return r.RenameExclusive(from, to)
+}
+
+// Size - the uncompressed length, less than zero if the file does not exist
+func (c *CompressedFolder) Size(filename string) int64 {
+	size := c.Destination.Size(filename)
+	opener, ok := c.Destination.(FileOpener)
+	if size < 0 || !ok {
+		return size
+	}
+
+	src, err := opener.Open(filename)
+	if err != nil {
+		return size
+	}
+	defer src.Close()
+	return uncompressedSize(src, size)
+}
+
+// Open - the uncompressed content of filename, when Destination is a FileOpener
+func (c *CompressedFolder) Open(filename string) (io.ReadCloser, error) {
+	opener, ok := c.Destination.(FileOpener)
+	if !ok {
+		return nil, me.NewErr("destination cannot open files", &me.KV{"filename", filename})
+	}
+	src, err := opener.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := DecompressReader(src)
+	if err != nil {
+		src.Close()
+		return nil, me.Err(err, "failed to decompress file", &me.KV{"filename", filename})
+	}
+	return &readCloser{Reader: r, Closer: multiCloser{r, src}}, nil
+}
+
+type compressedSource struct {
+	source FolderSource
+	// sizes - chunkSize by name
+	sizes  *sync.Map
+	forget func()
+}
+
+func (c *compressedSource) Files() ([]FileSource, error) {
+	files, err := c.source.Files()
+	if err != nil {
+		return nil, err
+	}
+	decompressed := make([]FileSource, len(files))
+	for i, f := range files {
+		decompressed[i] = &compressedFile{FileSource: f, sizes: c.sizes}
+	}
+	return decompressed, nil
+}
+
+func (c *compressedSource) Remove() error {
+	c.forget()
+	return c.source.Remove()
+}
+
+// chunkSize - the uncompressed size of a chunk stored with stored bytes
+type chunkSize struct {
+	stored       int64
+	uncompressed int64
+}
+
+type compressedFile struct {
+	FileSource
+	sizes *sync.Map
+}
+
+// Size - read from the size frame once, later calls are answered from sizes while the stored size is unchanged
+func (f *compressedFile) Size() int64 {
+	size := f.FileSource.Size()
+	if size < 0 {
+		return size
+	}
+	if known, ok := f.sizes.Load(f.Name()); ok && known.(chunkSize).stored == size {
+		return known.(chunkSize).uncompressed
+	}
+
+	src, err := f.FileSource.Open()
+	if err != nil {
+		return -1
+	}
+	defer src.Close()
+	uncompressed := uncompressedSize(src, size)
+	if uncompressed >= 0 {
+		f.sizes.Store(f.Name(), chunkSize{stored: size, uncompressed: uncompressed})
+	}
+	return uncompressed
+}
+
+func (f *compressedFile) Open() (io.ReadCloser, error) {
+	src, err := f.FileSource.Open()
+	if err != nil {
+		return nil, err
+	}
+	r, err := DecompressReader(src)
+	if err != nil {
+		src.Close()
+		return nil, me.Err(err, "failed to decompress file", &me.KV{"file", f.Uri()})
+	}
+	return &readCloser{Reader: r, Closer: multiCloser{r, src}}, nil
+}
+
+// uncompressedSize - read the size frame at the end of a compressed file of size bytes, or decompress it
+// if src cannot seek
+func uncompressedSize(src io.Reader, size int64) int64 {
+	if seeker, ok := src.(io.ReadSeeker); ok {
+		if n, err := readSizeFrame(seeker, size); err == nil {
+			return n
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return -1
+		}
+	}
+
+	r, err := DecompressReader(src)
+	if err != nil {
+		return -1
+	}
+	defer r.Close()
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func readSizeFrame(src io.ReadSeeker, size int64) (int64, error) {
+	head := make([]byte, len(zstdMagic))
+	if _, err := io.ReadFull(src, head); err != nil {
+		return 0, err
+	}
+
+	frameSize, at, build := gzipSizeFrame, gzipSizeAt, gzipSizeFrameBytes
+	if bytes.Equal(head, zstdMagic) {
+		frameSize, at, build = zstdSizeFrame, zstdSizeAt, zstdSizeFrameBytes
+	}
+	if size < int64(frameSize) {
+		return 0, me.NewErr("file too small for a size frame")
+	}
+	if _, err := src.Seek(size-int64(frameSize), io.SeekStart); err != nil {
+		return 0, err
+	}
+	frame := make([]byte, frameSize)
+	if _, err := io.ReadFull(src, frame); err != nil {
+		return 0, err
+	}
+
+	n := int64(binary.LittleEndian.Uint64(frame[at:]))
+	if !bytes.Equal(frame, build(n)) {
+		return 0, me.NewErr("no size frame")
+	}
+	return n, nil
+}
+
+// gzipSizeFrameBytes - an empty gzip member, FEXTRA subfield "CK" holds the size, the deflate data is an
+// empty final stored block, the crc and length of no data are zero
+func gzipSizeFrameBytes(size int64) []byte {
+	b := make([]byte, gzipSizeFrame)
+	copy(b, gzipMagic)
+	copy(b[2:], []byte{8, 4, 0, 0, 0, 0, 0, 255}) //deflate, FEXTRA, no mtime, no xfl, unknown os
+	binary.LittleEndian.PutUint16(b[10:], uint16(len(sizeFrameId)+2+8))
+	copy(b[12:], sizeFrameId)
+	binary.LittleEndian.PutUint16(b[14:], 8)
+	binary.LittleEndian.PutUint64(b[gzipSizeAt:], uint64(size))
+	copy(b[gzipSizeAt+8:], []byte{1, 0, 0, 0xff, 0xff})
+	return b
+}
+
+// zstdSizeFrameBytes - a skippable frame holding "CK" and the size
+func zstdSizeFrameBytes(size int64) []byte {
+	b := make([]byte, zstdSizeFrame)
+	binary.LittleEndian.PutUint32(b, zstdSkippableMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(sizeFrameId)+8))
+	copy(b[8:], sizeFrameId)
+	binary.LittleEndian.PutUint64(b[zstdSizeAt:], uint64(size))
+	return b
+}
+
+// DecompressReader - the content of a file written by CompressedFolder, gzip or zstd is detected
+func DecompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && len(head) < len(gzipMagic) {
+		return nil, me.Err(err, "failed to read compressed file")
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.Equal(head, zstdMagic):
+		d, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, me.Err(err, "failed to create zstd decoder")
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, me.NewErr("not a compressed file")
+}
+
+////////////////////////////
+
+type compressWriter struct {
+	w           io.WriteCloser
+	encoder     io.WriteCloser
+	compression Compression
+	size        int64
+	closed      bool
+	// folder, filename - where w writes, to delete a file that could not be finished
+	folder   FolderDestination
+	filename string
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	n, err := c.encoder.Write(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// Close - finish the compressed stream, then append the size frame
+func (c *compressWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	if err := c.encoder.Close(); err != nil {
+		c.drop()
+		return me.Err(err, "failed to finish compressed file")
+	}
+
+	frame := gzipSizeFrameBytes(c.size)
+	if c.compression == CompressZstd {
+		frame = zstdSizeFrameBytes(c.size)
+	}
+	if _, err := c.w.Write(frame); err != nil {
+		c.drop()
+		return me.Err(err, "failed to write size frame")
+	}
+	return c.w.Close()
+}
+
+// Abort - drop the file if the destination supports it
+func (c *compressWriter) Abort() error {
+	a, ok := c.w.(Aborter)
+	if !ok {
+		return me.NewErr("destination cannot abort")
+	}
+	c.closed = true
+	c.encoder.Close()
+	return a.Abort()
+}
+
+func (c *compressWriter) canAbort() bool {
+	return canAbort(c.w)
+}
+
+// drop - discard the unfinished file, deleting it if the destination committed it
+func (c *compressWriter) drop() {
+	if !Discard(c.w) {
+		c.folder.Delete(c.filename)
+	}
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var first error
+	for _, c := range m {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,142 @@
+package chunk_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// UnfinishedDestination - its writer fails to close and cannot abort
+type UnfinishedDestination struct {
+	RecordingDestination
+}
+
+func (d *UnfinishedDestination) Create(filename string) (io.WriteCloser, error) {
+	return d, nil
+}
+
+func (d *UnfinishedDestination) Close() error {
+	return errors.New("connection reset")
+}
+
+var _ = Describe("Compression", func() {
+	var folder string
+	var content []byte
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "compression")
+		content = bytes.Repeat([]byte("timestamp,level,message\n"), 20000)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	assemble := func(compression Compression) *UploadOutcome {
+		chunks := &CompressedDestination{Destination: &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}, Compression: compression}
+		source := uploadAll(chunks, "logs", content)
+
+		stored := (&FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}).Writer("logs").Size("1")
+		Expect(stored).To(BeNumerically("<", len(content)/10))
+
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: len(content), Identifier: "logs", Destination: chunks}
+		Expect(u.ChunkAlreadyUploaded()).To(BeTrue())
+
+		outcomes := make(chan *UploadOutcome, 1)
+		fa := &FileAssembler{}
+		fa.Start()
+		defer fa.Stop()
+		fa.Post(&AssembleFolder{
+			Source:      source,
+			Destination: &FileDestination{FolderRoot: filepath.Join(folder, "complete")},
+			Callback:    func(o *UploadOutcome) { outcomes <- o },
+		})
+		return <-outcomes
+	}
+
+	It("Should store gzip chunks and assemble the original content", func() {
+		o := assemble(CompressGzip)
+		Expect(o.Err).To(BeNil())
+		assembled, _ := ioutil.ReadFile(o.Uri)
+		Expect(assembled).To(Equal(content))
+	})
+
+	It("Should store zstd chunks and assemble the original content", func() {
+		o := assemble(CompressZstd)
+		Expect(o.Err).To(BeNil())
+		assembled, _ := ioutil.ReadFile(o.Uri)
+		Expect(assembled).To(Equal(content))
+	})
+
+	It("Should read the size of a chunk once", func() {
+		chunks := &CompressedDestination{Destination: &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}, Compression: CompressZstd}
+		uploadAll(chunks, "logs", content)
+		size := func() int64 {
+			files, err := chunks.Reader("logs").Files()
+			Expect(err).To(BeNil())
+			Expect(files).To(HaveLen(1))
+			return files[0].Size()
+		}
+		Expect(size()).To(Equal(int64(len(content))))
+
+		//the frame is not read again while the stored size is unchanged
+		chunk := filepath.Join(folder, "incomplete", "logs", "1")
+		stored, _ := ioutil.ReadFile(chunk)
+		Expect(ioutil.WriteFile(chunk, make([]byte, len(stored)), 0664)).To(BeNil())
+		Expect(size()).To(Equal(int64(len(content))))
+	})
+
+	It("Should delete a file it could not finish", func() {
+		failing := &FailingDestination{}
+		w, err := (&CompressedFolder{Destination: failing, Compression: CompressGzip}).Create("logs.csv.gz")
+		Expect(err).To(BeNil())
+		w.Write(content)
+		Expect(w.Close()).NotTo(BeNil())
+		Expect(failing.deleted).To(Equal([]string{"logs.csv.gz"}))
+	})
+
+	It("Should delete what a destination that cannot abort left behind", func() {
+		dest := &UnfinishedDestination{}
+		dest.fileSize = -1
+		source := uploadAll(&FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}, "logs", content)
+
+		outcomes := make(chan *UploadOutcome, 1)
+		fa := &FileAssembler{}
+		fa.Start()
+		defer fa.Stop()
+		fa.Post(&AssembleFolder{
+			Source:      source,
+			Destination: &CompressedFolder{Destination: dest, Compression: CompressGzip},
+			Callback:    func(o *UploadOutcome) { outcomes <- o },
+		})
+		o := <-outcomes
+		Expect(o.Err).NotTo(BeNil())
+		Expect(dest.deleted).To(Equal([]string{"logs"}))
+	})
+
+	It("Should keep the assembled file compressed for standard tools", func() {
+		complete := &CompressedFolder{Destination: &FileDestination{FolderRoot: folder}, Compression: CompressGzip}
+		w, err := complete.Create("logs.csv.gz")
+		Expect(err).To(BeNil())
+		w.Write(content)
+		Expect(w.Close()).To(BeNil())
+		Expect(complete.Size("logs.csv.gz")).To(Equal(int64(len(content))))
+
+		f, _ := os.Open(filepath.Join(folder, "logs.csv.gz"))
+		defer f.Close()
+		r, err := gzip.NewReader(f)
+		Expect(err).To(BeNil())
+		plain, err := ioutil.ReadAll(r)
+		Expect(err).To(BeNil())
+		Expect(plain).To(Equal(content))
+	})
+})
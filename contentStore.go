@@ -0,0 +1,149 @@
+package chunk
+
+import (
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/gotgo/fw/me"
+)
+
+// Deduplicator - implemented by destinations that may already hold the file to assemble
+type Deduplicator interface {
+	// Claim - if key is already stored, take a reference on it and return true, the assembler then
+	// skips writing the file and reports the existing uri
+	Claim(key string) (bool, error)
+}
+
+// ContentStore - content addressed storage on top of Destination. The sha256 of the assembled file is its
+// key, an identical upload is dropped and the uri of the stored copy returned. Keys of uploads with a tenant
+// are in a folder of the tenant, tenants never share content. Index counts the references so Delete only
+// removes the file when the last one is released. Use a FileRefIndex to keep the counts across restarts.
+type ContentStore struct {
+	Destination FolderDestination
+	// Index - reference counts, defaults to a MemoryRefIndex
+	Index RefIndex
+
+	once sync.Once
+	// mu - held while the index and the stored files change together, so a claim cannot race a delete
+	mu sync.Mutex
+}
+
+func (c *ContentStore) index() RefIndex {
+	c.once.Do(func() {
+		if c.Index == nil {
+			c.Index = &MemoryRefIndex{}
+		}
+	})
+	return c.Index
+}
+
+// ContentKey - the key of the content with the hex sha256 digest uploaded by tenant
+func ContentKey(tenant, digest string) string {
+	return SessionKey(tenant, strings.ToLower(digest))
+}
+
+// Resolve - the key is the sha256 of the file, the name chosen by AssembleFolder.Naming is ignored
+func (c *ContentStore) Resolve(info *UploadInfo, filename string) (FolderDestination, string, error) {
+	digest, err := info.Sha256()
+	if err != nil {
+		return nil, "", me.Err(err, "failed to hash upload", &me.KV{"identifier", info.Identifier})
+	}
+	return c, ContentKey(info.Tenant, digest), nil
+}
+
+// Claim - take a reference on key if it is stored. The check and the reference are one step, a concurrent
+// Delete of the last reference either happens before and the content is written again, or after and
+// keeps the file.
+func (c *ContentStore) Claim(key string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Destination.Size(key) < 0 {
+		return false, nil
+	}
+	if _, err := c.index().Add(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Lookup - the uri of the content with the hex sha256 digest uploaded by tenant, for clients that send the
+// hash before uploading. Returns false if the content is not stored. No reference is taken, Claim the
+// ContentKey when the session completes by hash.
+func (c *ContentStore) Lookup(tenant, digest string) (string, bool, error) {
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != 32 {
+		return "", false, me.NewErr("not a sha256 digest", &me.KV{"digest", digest})
+	}
+
+	key := ContentKey(tenant, digest)
+	if c.Destination.Size(key) < 0 {
+		return "", false, nil
+	}
+	return c.Uri(key), true, nil
+}
+
+// Create - the reference is taken once the writer closes successfully
+func (c *ContentStore) Create(key string) (io.WriteCloser, error) {
+	w, err := c.Destination.Create(key)
+	if err != nil {
+		return nil, err
+	}
+	return &refWriter{WriteCloser: w, store: c, key: key}, nil
+}
+
+// Delete - release a reference, the file is deleted with the last one
+func (c *ContentStore) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count, err := c.index().Release(key)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return c.Destination.Delete(key)
+}
+
+func (c *ContentStore) Uri(key string) string {
+	return c.Destination.Uri(key)
+}
+
+func (c *ContentStore) Size(key string) int64 {
+	return c.Destination.Size(key)
+}
+
+type refWriter struct {
+	io.WriteCloser
+	store *ContentStore
+	key   string
+	// aborted - the content was dropped, Close must not reference it
+	aborted bool
+}
+
+func (w *refWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil || w.aborted {
+		return err
+	}
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	if _, err := w.store.index().Add(w.key); err != nil {
+		return me.Err(err, "failed to reference stored content", &me.KV{"key", w.key})
+	}
+	return nil
+}
+
+// Abort - drop the content if the destination supports it, no reference is taken either way
+func (w *refWriter) Abort() error {
+	w.aborted = true
+	a, ok := w.WriteCloser.(Aborter)
+	if !ok {
+		return me.NewErr("destination cannot abort", &me.KV{"key", w.key})
+	}
+	return a.Abort()
+}
+
+func (w *refWriter) canAbort() bool {
+	return canAbort(w.WriteCloser)
+}
@@ -0,0 +1,170 @@
+package chunk_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// uploadAll - store content as a single chunk session and return the complete folder
+func uploadAll(chunks Destination, identifier string, content []byte) *ChunkFolder {
+	u := &ChunkUpload{
+		CurrentChunkNumber: 1,
+		CurrentChunkSize:   len(content),
+		ChunkSize:          len(content),
+		TotalSize:          int64(len(content)),
+		TotalChunks:        1,
+		Identifier:         identifier,
+		Filename:           "installer.exe",
+		Destination:        chunks,
+	}
+	folder, err := u.UploadChunk(bytes.NewReader(content))
+	Expect(err).To(BeNil())
+	Expect(folder.IsComplete()).To(BeTrue())
+	return folder
+}
+
+var _ = Describe("ContentStore", func() {
+	var folder string
+	var chunks *FileDestination
+	var store *ContentStore
+	var fa *FileAssembler
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "content")
+		chunks = &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		store = &ContentStore{
+			Destination: &FileDestination{FolderRoot: filepath.Join(folder, "complete")},
+			Index:       &FileRefIndex{Path: filepath.Join(folder, "refs.json")},
+		}
+		fa = &FileAssembler{}
+		fa.Start()
+	})
+
+	AfterEach(func() {
+		fa.Stop()
+		os.RemoveAll(folder)
+	})
+
+	//assembleWith - assemble source to the store on assembler and wait for the outcome
+	assembleWith := func(assembler *FileAssembler, source *ChunkFolder) *UploadOutcome {
+		outcomes := make(chan *UploadOutcome, 1)
+		assembler.Post(&AssembleFolder{
+			Source:      source,
+			Destination: store,
+			Callback:    func(o *UploadOutcome) { outcomes <- o },
+		})
+		var o *UploadOutcome
+		Eventually(outcomes).Should(Receive(&o))
+		return o
+	}
+
+	assemble := func(identifier string, content []byte) *UploadOutcome {
+		o := assembleWith(fa, uploadAll(chunks, identifier, content))
+		Expect(o.Err).To(BeNil())
+		return o
+	}
+
+	It("should store identical uploads once", func() {
+		content := []byte("the same installer, again and again")
+		first := assemble("first", content)
+		second := assemble("second", content)
+
+		Expect(first.Deduplicated).To(BeFalse())
+		Expect(second.Deduplicated).To(BeTrue())
+		Expect(second.Uri).To(Equal(first.Uri))
+		Expect(second.Digest).To(Equal(first.Digest))
+
+		//looking up takes no reference
+		uri, found, err := store.Lookup("", first.Digest)
+		Expect(err).To(BeNil())
+		Expect(found).To(BeTrue())
+		Expect(uri).To(Equal(first.Uri))
+
+		//two references, the file survives until the last is released
+		for i := 0; i < 2; i++ {
+			Expect(store.Size(first.Digest)).To(Equal(int64(len(content))))
+			Expect(store.Delete(first.Digest)).To(BeNil())
+		}
+		Expect(store.Size(first.Digest)).To(BeNumerically("<", 0))
+	})
+
+	It("should keep the content of tenants apart", func() {
+		content := []byte("a tenant's own installer")
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: len(content), ChunkSize: len(content),
+			TotalSize: int64(len(content)), TotalChunks: 1, Identifier: "mine", Tenant: "acme",
+			Filename: "installer.exe", Destination: chunks}
+		source, err := u.UploadChunk(bytes.NewReader(content))
+		Expect(err).NotTo(HaveOccurred())
+		o := assembleWith(fa, source)
+		Expect(o.Err).To(BeNil())
+
+		_, found, err := store.Lookup("acme", o.Digest)
+		Expect(err).To(BeNil())
+		Expect(found).To(BeTrue())
+		_, found, err = store.Lookup("", o.Digest)
+		Expect(err).To(BeNil())
+		Expect(found).To(BeFalse())
+
+		other := assemble("theirs", content)
+		Expect(other.Deduplicated).To(BeFalse())
+		Expect(other.Uri).NotTo(Equal(o.Uri))
+	})
+
+	It("should run the pipeline on deduplicated uploads", func() {
+		content := []byte("clean the first time, infected the second")
+		var scanned, thumbnails int
+		infected := false
+		pipeline := &Pipeline{Stages: []*Stage{
+			{Name: "scan", Processor: ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+				scanned++
+				if infected {
+					return Reject("infected")
+				}
+				return nil
+			})},
+			{Name: "thumbnail", SkipDeduplicated: true, Processor: ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+				thumbnails++
+				return nil
+			})},
+		}}
+		processing := &FileAssembler{Pipeline: pipeline}
+		processing.Start()
+		defer processing.Stop()
+		run := func(identifier string) *UploadOutcome {
+			return assembleWith(processing, uploadAll(chunks, identifier, content))
+		}
+
+		first := run("first")
+		Expect(first.Err).To(BeNil())
+		second := run("second")
+		Expect(second.Err).To(BeNil())
+		Expect(second.Deduplicated).To(BeTrue())
+		Expect(scanned).To(Equal(2))
+		Expect(thumbnails).To(Equal(1))
+
+		//a rejected duplicate releases only its own reference
+		infected = true
+		third := run("third")
+		Expect(IsRejected(third.Err)).To(BeTrue())
+		Expect(store.Index.Count(first.Digest)).To(Equal(2))
+	})
+
+	It("should not reference aborted content", func() {
+		w, err := store.Create("dropped")
+		Expect(err).To(BeNil())
+		w.Write([]byte("half an installer"))
+		Expect(w.(Aborter).Abort()).To(BeNil())
+
+		Expect(store.Size("dropped")).To(BeNumerically("<", 0))
+		Expect(store.Index.Count("dropped")).To(Equal(0))
+	})
+
+})
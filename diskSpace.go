@@ -0,0 +1,61 @@
+package chunk
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+)
+
+// errSpaceUnknown - free space cannot be measured on this platform, sessions are admitted unchecked
+var errSpaceUnknown = errors.New("free space unknown on this platform")
+
+// Admitter - implemented by folder destinations that can refuse a session before its first chunk is stored
+type Admitter interface {
+	// Admit - an error if a session of size bytes cannot be stored
+	Admit(size int64) error
+}
+
+// InsufficientSpaceError - a session refused because the filesystem holding it is too full
+type InsufficientSpaceError struct {
+	Path     string
+	Free     int64
+	Required int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return "insufficient space in " + e.Path + ": " + strconv.FormatInt(e.Free, 10) + " bytes free, " +
+		strconv.FormatInt(e.Required, 10) + " required"
+}
+
+// IsInsufficientSpace - true if err is an *InsufficientSpaceError
+func IsInsufficientSpace(err error) bool {
+	_, ok := err.(*InsufficientSpaceError)
+	return ok
+}
+
+// Admit - when SpaceCheck is on, refuse a session that would leave less than MinFreeSpace free on the
+// filesystem of FolderRoot. With AssemblySpace the assembled copy is counted too. Only the free space at
+// the time the session starts is checked, sessions in flight are not reserved.
+func (f *FileDestination) Admit(size int64) error {
+	if !f.SpaceCheck {
+		return nil
+	}
+
+	root, err := filepath.Abs(f.root())
+	if err != nil {
+		return nil
+	}
+	free, err := freeSpace(deepestExisting(root))
+	if err != nil {
+		return nil
+	}
+
+	required := size + f.MinFreeSpace
+	if f.AssemblySpace {
+		required += size
+	}
+	if free < required {
+		return &InsufficientSpaceError{Path: root, Free: free, Required: required}
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package chunk
+
+func freeSpace(path string) (int64, error) {
+	return 0, errSpaceUnknown
+}
@@ -0,0 +1,435 @@
+package chunk
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/gotgo/fw/me"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files are a fixed size header followed by AES-256-GCM sealed segments of segmentSize plaintext
+// bytes. Every file has its own key and nonce prefix, derived with HKDF-SHA256 from the key named in the
+// header and the header's random salt, so nonces never repeat under a key however many files it encrypts.
+// The nonce of a segment is the prefix, the segment counter and a flag marking the final segment, so
+// reordered, dropped or truncated segments fail to open. The header is authenticated as additional data of
+// every segment.
+const (
+	encryptionMagic   = "CHKE"
+	encryptionVersion = 2
+	maxKeyIdSize      = 32
+	saltSize          = 32
+	noncePrefixSize   = 7
+	headerSize        = len(encryptionMagic) + 1 + 1 + maxKeyIdSize + saltSize
+	segmentSize       = 64 * 1024
+	tagSize           = 16
+)
+
+// EncryptedDestination - a Destination that encrypts chunks at rest, see EncryptedFolder
+type EncryptedDestination struct {
+	Destination Destination
+	Keys        KeyProvider
+}
+
+func (e *EncryptedDestination) Writer(subfolder string) FolderDestination {
+	return &EncryptedFolder{Destination: e.Destination.Writer(subfolder), Keys: e.Keys}
+}
+
+func (e *EncryptedDestination) Reader(subfolder string) FolderSource {
+	return &encryptedSource{source: e.Destination.Reader(subfolder), keys: e.Keys}
+}
+
+// EncryptedFolder - a FolderDestination that encrypts every file with the current key of Keys. Size
+// reports the plaintext length, so it can also hold chunks. Read the files back with DecryptReader.
+type EncryptedFolder struct {
+	Destination FolderDestination
+	Keys        KeyProvider
+}
+
+func (e *EncryptedFolder) Create(filename string) (io.WriteCloser, error) {
+	w, err := e.Destination.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return e.wrap(w, filename)
+}
+
+// CreateExclusive - exclusive when Destination is an ExclusiveCreator
+func (e *EncryptedFolder) CreateExclusive(filename string) (io.WriteCloser, error) {
+	w, err := createExclusive(e.Destination, filename)
+	if err != nil {
+		return nil, err
+	}
+	return e.wrap(w, filename)
+}
+
+func (e *EncryptedFolder) wrap(w io.WriteCloser, filename string) (io.WriteCloser, error) {
+	ew, err := newEncryptWriter(w, e.Keys)
+	if err != nil {
+		if !Discard(w) {
+			e.Destination.Delete(filename)
+		}
+		return nil, err
+	}
+	ew.folder, ew.filename = e.Destination, filename
+	return ew, nil
+}
+
+// Admit - passed on to Destination
+func (e *EncryptedFolder) Admit(size int64) error {
+	if a, ok := e.Destination.(Admitter); ok {
+		return a.Admit(size)
+	}
+	return nil
+}
+
+func (e *EncryptedFolder) Delete(filename string) error {
+	return e.Destination.Delete(filename)
+}
+
+func (e *EncryptedFolder) Uri(filename string) string {
+	return e.Destination.Uri(filename)
+}
+
+// Rename - when Destination is a Renamer
+func (e *EncryptedFolder) Rename(from, to string) error {
+	r, ok := e.Destination.(Renamer)
+	if !ok {
+		return me.NewErr("destination cannot rename files", &me.KV{"from", from})
+	}
+	return r.Rename(from, to)
+}
+
+// RenameExclusive - when Destination is an ExclusiveRenamer
+func (e *EncryptedFolder) RenameExclusive(from, to string) error {
+	r, ok := e.Destination.(ExclusiveRenamer)
+	if !ok {
+		return me.NewErr("destination cannot rename files exclusively", &me.KV{"from", from})
+	}
+	return r.RenameExclusive(from, to)
+}
+
+// Open - the plaintext of filename, when Destination is a FileOpener
+func (e *EncryptedFolder) Open(filename string) (io.ReadCloser, error) {
+	opener, ok := e.Destination.(FileOpener)
+	if !ok {
+		return nil, me.NewErr("destination cannot open files", &me.KV{"filename", filename})
+	}
+	src, err := opener.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := DecryptReader(src, e.Keys)
+	if err != nil {
+		src.Close()
+		return nil, me.Err(err, "failed to decrypt file", &me.KV{"filename", filename})
+	}
+	return &readCloser{Reader: r, Closer: src}, nil
+}
+
+// Size - the plaintext length, less than zero if the file does not exist or is not encrypted
+func (e *EncryptedFolder) Size(filename string) int64 {
+	return plaintextSize(e.Destination.Size(filename))
+}
+
+type encryptedSource struct {
+	source FolderSource
+	keys   KeyProvider
+}
+
+func (e *encryptedSource) Files() ([]FileSource, error) {
+	files, err := e.source.Files()
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]FileSource, len(files))
+	for i, f := range files {
+		decrypted[i] = &encryptedFile{FileSource: f, keys: e.keys}
+	}
+	return decrypted, nil
+}
+
+func (e *encryptedSource) Remove() error {
+	return e.source.Remove()
+}
+
+type encryptedFile struct {
+	FileSource
+	keys KeyProvider
+}
+
+func (f *encryptedFile) Size() int64 {
+	return plaintextSize(f.FileSource.Size())
+}
+
+func (f *encryptedFile) Open() (io.ReadCloser, error) {
+	src, err := f.FileSource.Open()
+	if err != nil {
+		return nil, err
+	}
+	r, err := DecryptReader(src, f.keys)
+	if err != nil {
+		src.Close()
+		return nil, me.Err(err, "failed to decrypt file", &me.KV{"file", f.Uri()})
+	}
+	return &readCloser{Reader: r, Closer: src}, nil
+}
+
+// plaintextSize - the plaintext length of an encrypted file of size bytes
+func plaintextSize(size int64) int64 {
+	body := size - int64(headerSize)
+	if size < 0 || body < tagSize {
+		return -1
+	}
+	full := int64(segmentSize + tagSize)
+	segments := (body + full - 1) / full
+	return body - segments*tagSize
+}
+
+////////////////////////////
+
+type encryptWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+	closed  bool
+	// folder, filename - where w writes, to delete a file that could not be finished
+	folder   FolderDestination
+	filename string
+}
+
+func newEncryptWriter(w io.WriteCloser, keys KeyProvider) (*encryptWriter, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, me.Err(err, "failed to get encryption key")
+	}
+	if len(id) > maxKeyIdSize {
+		return nil, me.NewErr("encryption key id too long", &me.KV{"id", id})
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, encryptionMagic)
+	header[4] = encryptionVersion
+	header[5] = byte(len(id))
+	copy(header[6:], id)
+	if _, err = rand.Read(header[6+maxKeyIdSize:]); err != nil {
+		return nil, me.Err(err, "failed to generate salt")
+	}
+
+	aead, nonce, err := fileCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = w.Write(header); err != nil {
+		return nil, me.Err(err, "failed to write encryption header")
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		buf:    make([]byte, 0, segmentSize),
+		out:    make([]byte, 0, segmentSize+tagSize),
+	}, nil
+}
+
+// Write - a full segment is only sealed once more data arrives, so Close always has a final segment to seal
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == segmentSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	if err := e.seal(true); err != nil {
+		e.drop()
+		return err
+	}
+	return e.w.Close()
+}
+
+// Abort - drop the file if the destination supports it
+func (e *encryptWriter) Abort() error {
+	a, ok := e.w.(Aborter)
+	if !ok {
+		return me.NewErr("destination cannot abort")
+	}
+	e.closed = true
+	return a.Abort()
+}
+
+func (e *encryptWriter) canAbort() bool {
+	return canAbort(e.w)
+}
+
+// drop - discard the unfinished file, deleting it if the destination committed it
+func (e *encryptWriter) drop() {
+	if !Discard(e.w) {
+		e.folder.Delete(e.filename)
+	}
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	segmentNonce(e.nonce, e.counter, final)
+	e.out = e.aead.Seal(e.out[:0], e.nonce, e.buf, e.header)
+	e.counter++
+	e.buf = e.buf[:0]
+	if _, err := e.w.Write(e.out); err != nil {
+		return me.Err(err, "failed to write encrypted segment")
+	}
+	return nil
+}
+
+////////////////////////////
+
+// DecryptReader - the plaintext of an encrypted file, the key is looked up by the id in its header.
+// Read returns an error if the file was modified or truncated.
+func DecryptReader(r io.Reader, keys KeyProvider) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, segmentSize+tagSize)
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, me.Err(err, "failed to read encryption header")
+	}
+	if string(header[:4]) != encryptionMagic || header[4] != encryptionVersion || int(header[5]) > maxKeyIdSize {
+		return nil, me.NewErr("not an encrypted file")
+	}
+
+	id := string(header[6 : 6+int(header[5])])
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, nonce, err := fileCipher(key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		in:     make([]byte, segmentSize+tagSize),
+	}, nil
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint32
+	in      []byte
+	plain   []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.in)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && n < tagSize) {
+		return me.NewErr("encrypted file truncated")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return me.Err(err, "failed to read encrypted segment")
+	}
+
+	//the final segment is the one with nothing after it
+	final := err == io.ErrUnexpectedEOF
+	if !final {
+		if _, perr := d.r.Peek(1); perr == io.EOF {
+			final = true
+		}
+	}
+
+	segmentNonce(d.nonce, d.counter, final)
+	plain, err := d.aead.Open(d.in[:0], d.nonce, d.in[:n], d.header)
+	if err != nil {
+		return me.Err(err, "encrypted segment failed authentication")
+	}
+	d.counter++
+	d.plain = plain
+	d.done = final
+	return nil
+}
+
+////////////////////////////
+
+// fileCipher - the cipher of the file with header and a nonce holding its prefix, keyed with the file key
+// derived from key and the salt of the header
+func fileCipher(key, header []byte) (cipher.AEAD, []byte, error) {
+	if len(key) != keySize {
+		return nil, nil, me.NewErr("encryption key must be 32 bytes")
+	}
+	derived := make([]byte, keySize+noncePrefixSize)
+	kdf := hkdf.New(sha256.New, key, header[6+maxKeyIdSize:], []byte(encryptionMagic+" file key"))
+	if _, err := io.ReadFull(kdf, derived); err != nil {
+		return nil, nil, me.Err(err, "failed to derive file key")
+	}
+
+	block, err := aes.NewCipher(derived[:keySize])
+	if err != nil {
+		return nil, nil, me.Err(err, "failed to create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, me.Err(err, "failed to create cipher")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, derived[keySize:])
+	return aead, nonce, nil
+}
+
+// segmentNonce - prefix (7) | counter (4) | final flag (1)
+func segmentNonce(nonce []byte, counter uint32, final bool) {
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	nonce[noncePrefixSize+4] = 0
+	if final {
+		nonce[noncePrefixSize+4] = 1
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
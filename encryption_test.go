@@ -0,0 +1,122 @@
+package chunk_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+	var folder string
+	var keys *KeyFile
+	var content []byte
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "encryption")
+		keyPath := filepath.Join(folder, "keys")
+		ioutil.WriteFile(keyPath, []byte("# rotated keys\nold "+strings.Repeat("ab", 32)+"\nnew "+strings.Repeat("cd", 32)+"\n"), 0600)
+		keys = &KeyFile{Path: keyPath}
+		content = bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	It("Should encrypt chunks and assembled files at rest", func() {
+		chunks := &EncryptedDestination{Destination: &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}, Keys: keys}
+		complete := &FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+
+		outcomes := make(chan *UploadOutcome, 1)
+		fa := &FileAssembler{}
+		fa.Start()
+		defer fa.Stop()
+		fa.Post(&AssembleFolder{
+			Source:      uploadAll(chunks, "secret", content),
+			Destination: &EncryptedFolder{Destination: complete, Keys: keys},
+			Callback:    func(o *UploadOutcome) { outcomes <- o },
+		})
+		o := <-outcomes
+		Expect(o.Err).To(BeNil())
+		Expect(o.Size).To(Equal(int64(len(content))))
+
+		raw, err := ioutil.ReadFile(filepath.Join(folder, "complete", "secret"))
+		Expect(err).To(BeNil())
+		Expect(bytes.Contains(raw, content[:64])).To(BeFalse())
+		Expect((&EncryptedFolder{Destination: complete, Keys: keys}).Size("secret")).To(Equal(int64(len(content))))
+
+		r, err := DecryptReader(bytes.NewReader(raw), keys)
+		Expect(err).To(BeNil())
+		plain, err := ioutil.ReadAll(r)
+		Expect(err).To(BeNil())
+		Expect(plain).To(Equal(content))
+	})
+
+	It("Should detect truncated files", func() {
+		var buf bytes.Buffer
+		w, err := (&EncryptedFolder{Destination: &bufferFolder{&buf}, Keys: keys}).Create("file")
+		Expect(err).To(BeNil())
+		w.Write(content)
+		Expect(w.Close()).To(BeNil())
+
+		raw := buf.Bytes()
+		r, err := DecryptReader(bytes.NewReader(raw[:len(raw)-100]), keys)
+		Expect(err).To(BeNil())
+		_, err = ioutil.ReadAll(r)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("Should encrypt every file with its own key", func() {
+		encrypt := func() []byte {
+			var buf bytes.Buffer
+			w, err := (&EncryptedFolder{Destination: &bufferFolder{&buf}, Keys: keys}).Create("file")
+			Expect(err).To(BeNil())
+			w.Write(content)
+			Expect(w.Close()).To(BeNil())
+			return buf.Bytes()
+		}
+		first, second := encrypt(), encrypt()
+		Expect(len(first)).To(Equal(len(second)))
+
+		//the same key id, different salts and nothing in common after the header
+		header := 4 + 1 + 1 + 32
+		Expect(first[:header]).To(Equal(second[:header]))
+		Expect(first[header : header+32]).NotTo(Equal(second[header : header+32]))
+		Expect(bytes.Contains(second, first[len(first)-64:])).To(BeFalse())
+		Expect(bytes.Contains(second, first[header+32:header+96])).To(BeFalse())
+
+		for _, raw := range [][]byte{first, second} {
+			r, err := DecryptReader(bytes.NewReader(raw), keys)
+			Expect(err).To(BeNil())
+			plain, err := ioutil.ReadAll(r)
+			Expect(err).To(BeNil())
+			Expect(plain).To(Equal(content))
+		}
+	})
+})
+
+// bufferFolder - a FolderDestination holding a single file in memory
+type bufferFolder struct {
+	buf *bytes.Buffer
+}
+
+func (b *bufferFolder) Create(filename string) (io.WriteCloser, error) {
+	return nopWriteCloser{b.buf}, nil
+}
+func (b *bufferFolder) Delete(filename string) error { b.buf.Reset(); return nil }
+func (b *bufferFolder) Uri(filename string) string   { return "mem://" + filename }
+func (b *bufferFolder) Size(filename string) int64   { return int64(b.buf.Len()) }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -1,60 +1,160 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gotgo/chunk"
+	"github.com/gotgo/chunk/extract"
 	"github.com/gotgo/chunk/flow"
+	"github.com/gotgo/chunk/images"
+	"github.com/gotgo/chunk/metrics"
+	"github.com/gotgo/chunk/ratelimit"
+	"github.com/gotgo/chunk/scan"
+	"github.com/gotgo/chunk/token"
 )
 
 var assembler *chunk.FileAssembler
 var dest chunk.FolderDestination
+var uploads *flow.Handler
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	assembler = &chunk.FileAssembler{}
+	registry := metrics.NewRegistry()
+	observer := metrics.NewObserver(registry)
+
+	//4GB files at most, 20 unfinished uploads per user, settled by the assembler
+	limits := &chunk.Limits{MaxFileSize: 4 << 30, MaxSessions: 20, Accounting: &chunk.FileAccounting{Path: "/tmp/uploads/accounting.json"}}
+
+	assembler = &chunk.FileAssembler{Observer: chunk.Observers{observer, limits}, Pipeline: &chunk.Pipeline{}}
+	if clamd := os.Getenv("CLAMD_ADDRESS"); clamd != "" {
+		//nothing is published unchecked, infected files are kept aside for inspection
+		assembler.Pipeline.Stages = append(assembler.Pipeline.Stages, &chunk.Stage{
+			Name:      "scan",
+			Processor: &scan.Processor{Scanner: &scan.Clamd{Address: clamd}, Quarantine: &chunk.FileDestination{FolderRoot: "/tmp/uploads/quarantine"}},
+			Timeout:   5 * time.Minute,
+		})
+	}
+	//thumbnails and EXIF free copies of photos, a broken image is still delivered
+	assembler.Pipeline.Stages = append(assembler.Pipeline.Stages, &chunk.Stage{
+		Name:         "images",
+		Processor:    &images.Processor{Variants: []images.Variant{{Name: "thumb", MaxWidth: 256, MaxHeight: 256}, {Name: "web", MaxWidth: 2048, Format: "jpeg"}}},
+		Timeout:      time.Minute,
+		OnError:      chunk.ErrorContinue,
+		ContentTypes: images.Formats,
+	})
+	//project folders uploaded as zip or tar.gz are unpacked next to the archive
+	assembler.Pipeline.Stages = append(assembler.Pipeline.Stages, &chunk.Stage{
+		Name:         "extract",
+		Processor:    &extract.Processor{MaxSize: 4 << 30},
+		Timeout:      10 * time.Minute,
+		ContentTypes: extract.Formats,
+	})
 	assembler.Start()
 	defer assembler.Stop()
+	observer.WatchAssembler(assembler)
 
-	dest = &chunk.FileDestination{FolderRoot: "/tmp/uploads/complete"}
+	//large videos and small images get their own folders, everything else lands in complete
+	dest = &chunk.Router{
+		Rules: []*chunk.Rule{
+			{
+				ContentTypes: []string{"video/*"},
+				MinSize:      100 << 20,
+				KeyTemplate:  "{yyyy}/{mm}/{sha256}{ext}",
+				Destination:  &chunk.FileDestination{FolderRoot: "/tmp/uploads/videos"},
+			},
+			{
+				ContentTypes: []string{"image/*"},
+				MaxSize:      10 << 20,
+				Destination:  &chunk.FileDestination{FolderRoot: "/tmp/uploads/images"},
+			},
+		},
+		Default: &chunk.FileDestination{FolderRoot: "/tmp/uploads/complete"},
+	}
+	//refuse sessions that would leave less than 1GB free, counting the assembled copy on the same disk
+	chunks := &chunk.FileDestination{FolderRoot: "/tmp/uploads/incomplete", SpaceCheck: true, MinFreeSpace: 1 << 30, AssemblySpace: true}
+	uploads = &flow.Handler{Destination: chunks, Observer: observer, Assembler: assembler, Limits: limits}
+	//only images, PDFs, videos and archives to extract, named for what they contain
+	uploads.FileTypes = &chunk.FileTypes{
+		Allow:          append([]string{"image/*", "application/pdf", "video/*"}, extract.Formats...),
+		Deny:           []string{"image/svg+xml"},
+		RejectMismatch: true,
+	}
+	//flow.js sends 3 chunks at once by default, allow a few more and 10MB/s per client, 100MB/s in total
+	uploads.RateLimit = &ratelimit.Limiter{
+		Requests:    ratelimit.Budget{Rate: 10, Burst: 20},
+		Bytes:       ratelimit.Budget{Rate: 10 << 20},
+		GlobalBytes: ratelimit.Budget{Rate: 100 << 20},
+	}
+	if secret := os.Getenv("UPLOAD_TOKEN_SECRET"); secret != "" {
+		//only accept uploads pre-authorized by the API server sharing the secret
+		uploads.Tokens = &token.Signer{Secret: []byte(secret)}
+	}
 
 	m := http.NewServeMux()
 	m.HandleFunc("/upload", uploadHandler)
+	m.HandleFunc("/upload/status", statusHandler)
+	m.Handle("/metrics", registry)
 	handler := handlers.LoggingHandler(os.Stdout, m)
 	http.ListenAndServe(":3002", handler)
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	localFolder := &chunk.FileDestination{FolderRoot: "/tmp/uploads/incomplete"}
-
+	if !uploads.Throttle(w, r) {
+		return
+	}
 	var code int
 	var msg string
 	var pieces *chunk.ChunkFolder
+	var err error
 
 	if r.Method == "POST" {
-		pieces, code, msg = flow.UploadChunk(r, localFolder)
+		pieces, code, msg, err = uploads.UploadChunk(r)
 		if pieces != nil && pieces.IsComplete() {
+			//the final uri depends on the route, it is known once assembly completes
 			assembler.Post(&chunk.AssembleFolder{Source: pieces, Destination: dest, Callback: completed, Data: nil})
-			uri := dest.Uri(pieces.Filename)
-			w.Write([]byte(uri))
 		}
 	} else if r.Method == "GET" {
-		_, code, msg = flow.ChunkAlreadyUploaded(r, localFolder)
+		_, code, msg = uploads.ChunkAlreadyUploaded(r)
+	} else if r.Method == "DELETE" {
+		code, msg, err = uploads.AbortUpload(r)
 	} else {
 		panic("unknown method")
 	}
+	if err != nil {
+		msg += ": " + getErrorMessage(err)
+	}
 	w.WriteHeader(code)
 	w.Write([]byte(msg))
 
 }
 
+// statusHandler - the received and missing chunks of flowIdentifier as JSON
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !uploads.Throttle(w, r) {
+		return
+	}
+	status, code, msg, err := uploads.Status(r)
+	if status == nil {
+		if err != nil {
+			msg += ": " + getErrorMessage(err)
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(msg))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
 func completed(outcome *chunk.UploadOutcome) {
-	fmt.Printf("complete")
+	fmt.Printf("complete %s\n", outcome.Uri)
 }
 
 func getErrorMessage(e interface{}) string {
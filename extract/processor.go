@@ -0,0 +1,413 @@
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/fw/me"
+)
+
+// MetadataKey - the UploadOutcome.Metadata entry holding the *Listing of an archive
+const MetadataKey = "archive"
+
+const (
+	defaultMaxEntries = 10000
+	defaultMaxSize    = 1 << 30
+	defaultMaxRatio   = 100
+)
+
+// Formats - the media types Processor extracts, use them as Stage.ContentTypes. Gzip files are only
+// extracted when they hold a tar.
+var Formats = []string{"application/zip", "application/x-tar", "application/x-gzip"}
+
+// archiveExtensions - trimmed from the filename to name the folder entries are extracted to
+var archiveExtensions = []string{".tar.gz", ".tgz", ".zip", ".tar", ".gz"}
+
+// Listing - what was extracted from an archive
+type Listing struct {
+	Format string `json:"format"`
+	// Folder - where the entries are, below the destination
+	Folder string `json:"folder"`
+	Files  []File `json:"files"`
+	// Skipped - entries that are not regular files, such as symlinks, which are never extracted
+	Skipped []string `json:"skipped,omitempty"`
+	Size    int64    `json:"size"`
+}
+
+// File - an extracted entry
+type File struct {
+	// Path - the entry's path inside the archive
+	Path string `json:"path"`
+	Name string `json:"name"`
+	Uri  string `json:"uri"`
+	Size int64  `json:"size"`
+}
+
+// Processor - a chunk.Processor unpacking zip, tar and tar.gz files into a folder named after the archive,
+// "project.zip" is extracted to "project/". The collision policy of the assembly's Naming applies to that
+// folder, with CollisionSuffix an existing "project/" makes it "project-1/". Entries never replace a file
+// that was there before, with CollisionOverwrite an archive that would is rejected. Archives with entries
+// escaping the folder, more than MaxEntries entries or extracting to more than MaxSize bytes or MaxRatio
+// times their own size are rejected too, and whatever was extracted from them is deleted. Symlinks, hard
+// links and devices are skipped, their content still counts against MaxSize and MaxRatio. Sizes are counted
+// while extracting, headers are not trusted.
+type Processor struct {
+	// Destination - optional, where entries are extracted to, defaults to the pipeline's Derivatives.
+	// Without it every entry is also listed in UploadOutcome.Derived.
+	Destination chunk.FolderDestination
+	// MaxEntries - entries of any kind, defaults to 10000
+	MaxEntries int
+	// MaxSize - bytes extracted in total, defaults to 1GB
+	MaxSize int64
+	// MaxRatio - bytes extracted per byte of the archive, defaults to 100
+	MaxRatio int64
+	// TempDir - where zip files are copied to for random access when the assembled file cannot be read at
+	// an offset, as on encrypted or compressed destinations. Defaults to the system temp folder.
+	TempDir string
+}
+
+func (p *Processor) Process(ctx context.Context, f *chunk.ProcessedFile) error {
+	e := &extraction{Processor: p, ctx: ctx, f: f, listing: &Listing{Folder: folder(f.Filename)},
+		extracted: make(map[string]bool)}
+	err := e.run()
+	if err != nil {
+		e.cleanup()
+		return err
+	}
+	if e.listing.Format != "" {
+		f.SetMetadata(MetadataKey, e.listing)
+	}
+	return nil
+}
+
+// folder - the folder an archive named filename is extracted to
+func folder(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(lower, ext) && len(filename) > len(ext) {
+			return filename[:len(filename)-len(ext)]
+		}
+	}
+	return filename + ".contents" //the archive itself may be named filename
+}
+
+// extraction - the state of extracting one archive
+type extraction struct {
+	*Processor
+	ctx     context.Context
+	f       *chunk.ProcessedFile
+	listing *Listing
+	entries int
+	// read - bytes read from the entries, extracted or skipped
+	read int64
+	// extracted - names written by this extraction, a later entry of the same name replaces them
+	extracted map[string]bool
+	// created - the files extracted to Destination, deleted when the archive is rejected
+	created []string
+}
+
+func (e *extraction) run() error {
+	switch e.f.Info.MediaType() {
+	case "application/zip":
+		return e.zip()
+	case "application/x-tar":
+		r, err := e.f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return e.tar("tar", r)
+	case "application/x-gzip":
+		r, err := e.f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return e.gzip(r)
+	}
+	return nil
+}
+
+// gzip - extract r when it is a gzipped tar, other gzip files are left alone
+func (e *extraction) gzip(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return me.Err(err, "failed to read gzip archive", &me.KV{"filename", e.f.Filename})
+	}
+	defer gz.Close()
+
+	br := bufio.NewReaderSize(gz, 512)
+	head, _ := br.Peek(512)
+	if chunk.DetectContentType(head) != "application/x-tar" {
+		return nil
+	}
+	return e.tar("tar.gz", br)
+}
+
+// start - the archive is of format, pick the folder it is extracted to
+func (e *extraction) start(format string) error {
+	e.listing.Format = format
+	folder, err := e.f.AvoidCollision(e.listing.Folder, e.Destination)
+	if err != nil {
+		return me.Err(err, "failed to name extraction folder", &me.KV{"folder", e.listing.Folder})
+	}
+	e.listing.Folder = folder
+	return nil
+}
+
+func (e *extraction) tar(format string, r io.Reader) error {
+	if err := e.start(format); err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return me.Err(err, "failed to read tar archive", &me.KV{"filename", e.f.Filename})
+		}
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		kind := kindOther
+		if h.Typeflag == tar.TypeDir {
+			kind = kindDir
+		} else if h.Typeflag == tar.TypeReg {
+			kind = kindFile
+		}
+		if err = e.add(h.Name, kind, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *extraction) zip() error {
+	if err := e.start("zip"); err != nil {
+		return err
+	}
+	src, err := e.f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	ra, ok := src.(io.ReaderAt)
+	size := e.f.Size
+	if !ok {
+		tmp, err := ioutil.TempFile(e.TempDir, "extract-")
+		if err != nil {
+			return me.Err(err, "failed to create temp file for zip archive")
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		if size, err = io.Copy(tmp, src); err != nil {
+			return me.Err(err, "failed to copy zip archive", &me.KV{"filename", e.f.Filename})
+		}
+		ra = tmp
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return chunk.Reject("not a readable zip archive: " + err.Error())
+	}
+	if len(zr.File) > e.maxEntries() {
+		return chunk.Reject("archive has more than " + strconv.Itoa(e.maxEntries()) + " entries")
+	}
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		kind := kindOther
+		if mode.IsDir() {
+			kind = kindDir
+		} else if mode.IsRegular() {
+			kind = kindFile
+		}
+		if kind != kindFile {
+			if err = e.add(zf.Name, kind, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return me.Err(err, "failed to open zip entry", &me.KV{"entry", zf.Name})
+		}
+		err = e.add(zf.Name, kind, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	kindFile = iota
+	kindDir
+	kindOther
+)
+
+// add - extract one entry, r is drained when it is not extracted
+func (e *extraction) add(entry string, kind int, r io.Reader) error {
+	if err := e.ctx.Err(); err != nil {
+		return err
+	}
+	if e.entries++; e.entries > e.maxEntries() {
+		return chunk.Reject("archive has more than " + strconv.Itoa(e.maxEntries()) + " entries")
+	}
+
+	rel, ok := entryPath(entry)
+	if !ok {
+		return chunk.Reject("archive entry escapes its folder: " + entry)
+	}
+	if kind != kindFile || rel == "" {
+		if kind == kindOther {
+			e.listing.Skipped = append(e.listing.Skipped, entry)
+		}
+		if r == nil {
+			return nil
+		}
+		_, err := e.copy(ioutil.Discard, r)
+		return err
+	}
+
+	name := e.listing.Folder + "/" + rel
+	w, uri, err := e.create(name)
+	if err != nil {
+		return err
+	}
+
+	n, err := e.copy(w, r)
+	if err != nil {
+		if !chunk.Discard(w) {
+			e.remove(name)
+		}
+		return err
+	}
+	if err = w.Close(); err != nil {
+		if err == chunk.ErrFileExists {
+			return chunk.Reject("archive entry would replace an existing file: " + name)
+		}
+		if chunk.LeftBehind(w) {
+			e.remove(name)
+		}
+		return me.Err(err, "failed to write extracted file", &me.KV{"name", name})
+	}
+	if !e.extracted[name] && e.Destination != nil {
+		e.created = append(e.created, name)
+	}
+	e.extracted[name] = true
+
+	e.listing.Size += n
+	e.listing.Files = append(e.listing.Files, File{Path: entry, Name: name, Uri: uri, Size: n})
+	return nil
+}
+
+// copy - r to w within the budget
+func (e *extraction) copy(w io.Writer, r io.Reader) (int64, error) {
+	budget, reason := e.budget()
+	n, err := io.Copy(w, io.LimitReader(r, budget+1))
+	e.read += n
+	if err == nil && n > budget {
+		err = chunk.Reject(reason)
+	}
+	return n, err
+}
+
+// budget - the bytes that may still be extracted and the reason to reject the archive when they are exceeded
+func (e *extraction) budget() (int64, string) {
+	max := e.MaxSize
+	if max <= 0 {
+		max = defaultMaxSize
+	}
+	ratio := e.MaxRatio
+	if ratio <= 0 {
+		ratio = defaultMaxRatio
+	}
+	archive := e.f.Size
+	if archive < 1 {
+		archive = 1
+	}
+
+	if archive*ratio < max {
+		return archive*ratio - e.read, "archive extracts to more than " + strconv.FormatInt(ratio, 10) + " times its size"
+	}
+	return max - e.read, "archive extracts to more than " + strconv.FormatInt(max, 10) + " bytes"
+}
+
+func (e *extraction) maxEntries() int {
+	if e.MaxEntries > 0 {
+		return e.MaxEntries
+	}
+	return defaultMaxEntries
+}
+
+// create - an extracted file in Destination, or a derived file of the pipeline. A file that was there before
+// rejects the archive, Destination creates it exclusively when it can so one written meanwhile does too.
+func (e *extraction) create(name string) (io.WriteCloser, string, error) {
+	ours := e.extracted[name]
+	if !ours && e.exists(name) {
+		return nil, "", chunk.Reject("archive entry would replace an existing file: " + name)
+	}
+	if e.Destination == nil {
+		w, err := e.f.Create(name)
+		return w, e.f.DerivedUri(name), err
+	}
+
+	var w io.WriteCloser
+	var err error
+	if x, ok := e.Destination.(chunk.ExclusiveCreator); ok && !ours {
+		w, err = x.CreateExclusive(name)
+	} else {
+		w, err = e.Destination.Create(name)
+	}
+	if err != nil {
+		return nil, "", me.Err(err, "failed to create extracted file", &me.KV{"name", name})
+	}
+	return w, e.Destination.Uri(name), nil
+}
+
+func (e *extraction) exists(name string) bool {
+	if e.Destination == nil {
+		return e.f.DerivedSize(name) >= 0
+	}
+	return e.Destination.Size(name) >= 0
+}
+
+// remove - delete what a failed entry left in Destination, the pipeline deletes its derived files itself
+func (e *extraction) remove(name string) {
+	if e.Destination != nil {
+		_ = e.Destination.Delete(name)
+	}
+}
+
+// cleanup - delete the files the extraction added to Destination
+func (e *extraction) cleanup() {
+	for _, name := range e.created {
+		_ = e.Destination.Delete(name)
+	}
+}
+
+// entryPath - the sanitized path of an archive entry, false when it is absolute or climbs out of the folder
+func entryPath(entry string) (string, bool) {
+	p := strings.Replace(entry, "\\", "/", -1)
+	if strings.HasPrefix(p, "/") || (len(p) >= 2 && p[1] == ':') || strings.IndexByte(p, 0) >= 0 {
+		return "", false
+	}
+	if clean := path.Clean(p); clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", false
+	}
+	return chunk.SanitizePath(p), true
+}
@@ -0,0 +1,209 @@
+package extract_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/extract"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type entry struct {
+	name    string
+	content string
+	symlink bool
+	//typeflag - of a tar entry that is neither a file nor a symlink
+	typeflag byte
+}
+
+func zipOf(entries ...entry) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		if e.symlink {
+			h.SetMode(os.ModeSymlink | 0777)
+		}
+		w, _ := zw.CreateHeader(h)
+		w.Write([]byte(e.content))
+	}
+	zw.Close()
+	return b.Bytes()
+}
+
+func tarGzOf(entries ...entry) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.symlink {
+			h = &tar.Header{Name: e.name, Linkname: e.content, Typeflag: tar.TypeSymlink}
+		} else if e.typeflag != 0 {
+			h.Typeflag = e.typeflag
+		}
+		tw.WriteHeader(h)
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	gz.Close()
+	return b.Bytes()
+}
+
+var _ = Describe("Processor", func() {
+	var folder string
+	var chunks, complete *chunk.FileDestination
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "extract")
+		chunks = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	assembleNamed := func(processor *Processor, filename string, content []byte, naming chunk.Naming) *chunk.UploadOutcome {
+		u := &chunk.ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: len(content), ChunkSize: len(content), TotalSize: int64(len(content)),
+			TotalChunks: 1, Identifier: filename, Filename: filename, Destination: chunks}
+		source, err := u.UploadChunk(bytes.NewReader(content))
+		Expect(err).NotTo(HaveOccurred())
+
+		pipeline := &chunk.Pipeline{Stages: []*chunk.Stage{{Name: "extract", Processor: processor, ContentTypes: Formats}}}
+		fa := &chunk.FileAssembler{Pipeline: pipeline}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *chunk.UploadOutcome, 1)
+		fa.Post(&chunk.AssembleFolder{Source: source, Destination: complete, Naming: naming,
+			Callback: func(o *chunk.UploadOutcome) { outcomes <- o }})
+
+		var outcome *chunk.UploadOutcome
+		Eventually(outcomes, 5*time.Second).Should(Receive(&outcome))
+		return outcome
+	}
+
+	assemble := func(processor *Processor, filename string, content []byte) *chunk.UploadOutcome {
+		return assembleNamed(processor, filename, content, chunk.Naming{Policy: chunk.NameByOriginal})
+	}
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(complete.FolderRoot, name))
+		Expect(err).NotTo(HaveOccurred())
+		return string(b)
+	}
+
+	It("should extract zip files and skip symlinks", func() {
+		archive := zipOf(entry{name: "src/"}, entry{name: "src/main.go", content: "package main"},
+			entry{name: "README", content: "hello"}, entry{name: "link", content: "/etc/passwd", symlink: true})
+		outcome := assemble(&Processor{}, "project.zip", archive)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+
+		listing := outcome.Metadata[MetadataKey].(*Listing)
+		Expect(listing.Format).To(Equal("zip"))
+		Expect(listing.Folder).To(Equal("project"))
+		Expect(listing.Files).To(HaveLen(2))
+		Expect(listing.Files[0].Name).To(Equal("project/src/main.go"))
+		Expect(listing.Skipped).To(Equal([]string{"link"}))
+		Expect(read("project/src/main.go")).To(Equal("package main"))
+		Expect(read("project.zip")).To(Equal(string(archive)))
+	})
+
+	It("should extract gzipped tar files into Destination", func() {
+		extracted := &chunk.FileDestination{FolderRoot: filepath.Join(folder, "extracted")}
+		archive := tarGzOf(entry{name: "a.txt", content: "a"}, entry{name: "b/c.txt", content: "bc"}, entry{name: "evil", content: "../../x", symlink: true})
+		outcome := assemble(&Processor{Destination: extracted}, "backup.tar.gz", archive)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+
+		listing := outcome.Metadata[MetadataKey].(*Listing)
+		Expect(listing.Format).To(Equal("tar.gz"))
+		Expect(listing.Size).To(Equal(int64(3)))
+		Expect(outcome.Derived).To(BeEmpty())
+		Expect(extracted.Size("backup/b/c.txt")).To(Equal(int64(2)))
+	})
+
+	It("should reject entries escaping the folder", func() {
+		outcome := assemble(&Processor{}, "slip.zip", zipOf(entry{name: "ok.txt", content: "ok"}, entry{name: "../../evil.sh", content: "rm -rf"}))
+		Expect(chunk.IsRejected(outcome.Err)).To(BeTrue())
+		Expect(complete.Size("slip/ok.txt")).To(Equal(int64(-1)))
+		Expect(complete.Size("slip.zip")).To(Equal(int64(-1)))
+	})
+
+	It("should reject decompression bombs and too many entries", func() {
+		bomb := zipOf(entry{name: "zeros", content: string(make([]byte, 10<<20))})
+		outcome := assemble(&Processor{}, "bomb.zip", bomb)
+		Expect(chunk.IsRejected(outcome.Err)).To(BeTrue())
+		Expect(outcome.Err.Error()).To(ContainSubstring("times its size"))
+
+		outcome = assemble(&Processor{MaxSize: 4}, "big.tar.gz", tarGzOf(entry{name: "a", content: "12345"}))
+		Expect(outcome.Err.Error()).To(ContainSubstring("4 bytes"))
+
+		var many []entry
+		for i := 0; i < 11; i++ {
+			many = append(many, entry{name: strconv.Itoa(i), content: "x"})
+		}
+		outcome = assemble(&Processor{MaxEntries: 10}, "many.zip", zipOf(many...))
+		Expect(outcome.Err.Error()).To(ContainSubstring("more than 10 entries"))
+	})
+
+	It("should count the content of skipped entries", func() {
+		archive := tarGzOf(entry{name: "a.txt", content: "a"}, entry{name: "hidden", content: string(make([]byte, 1<<20)), typeflag: 'X'})
+		outcome := assemble(&Processor{MaxSize: 1 << 10}, "skip.tar.gz", archive)
+		Expect(chunk.IsRejected(outcome.Err)).To(BeTrue())
+		Expect(outcome.Err.Error()).To(ContainSubstring("1024 bytes"))
+	})
+
+	It("should apply the collision policy to the folder", func() {
+		extracted := &chunk.FileDestination{FolderRoot: filepath.Join(folder, "extracted")}
+		w, err := extracted.Create("project/README")
+		Expect(err).NotTo(HaveOccurred())
+		w.Write([]byte("mine"))
+		Expect(w.Close()).To(Succeed())
+
+		outcome := assembleNamed(&Processor{Destination: extracted}, "project.zip", zipOf(entry{name: "README", content: "theirs"}),
+			chunk.Naming{Policy: chunk.NameByOriginal, Collision: chunk.CollisionSuffix})
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Metadata[MetadataKey].(*Listing).Folder).To(Equal("project-1"))
+		Expect(extracted.Size("project/README")).To(Equal(int64(4)))
+		Expect(extracted.Size("project-1/README")).To(Equal(int64(6)))
+	})
+
+	It("should never replace files that were there before", func() {
+		extracted := &chunk.FileDestination{FolderRoot: filepath.Join(folder, "extracted")}
+		for _, d := range []*chunk.FileDestination{extracted, complete} {
+			w, err := d.Create("slip/ok.txt")
+			Expect(err).NotTo(HaveOccurred())
+			w.Write([]byte("mine"))
+			Expect(w.Close()).To(Succeed())
+		}
+
+		archive := zipOf(entry{name: "new.txt", content: "new"}, entry{name: "ok.txt", content: "theirs"})
+		outcome := assemble(&Processor{Destination: extracted}, "slip.zip", archive)
+		Expect(chunk.IsRejected(outcome.Err)).To(BeTrue())
+		Expect(outcome.Err.Error()).To(ContainSubstring("replace an existing file"))
+		Expect(extracted.Size("slip/new.txt")).To(Equal(int64(-1)))
+		b, _ := ioutil.ReadFile(filepath.Join(extracted.FolderRoot, "slip/ok.txt"))
+		Expect(string(b)).To(Equal("mine"))
+
+		//derived files of a rejected upload are deleted, the file that was there stays
+		outcome = assemble(&Processor{}, "slip.zip", archive)
+		Expect(chunk.IsRejected(outcome.Err)).To(BeTrue())
+		Expect(complete.Size("slip/new.txt")).To(Equal(int64(-1)))
+		Expect(read("slip/ok.txt")).To(Equal("mine"))
+	})
+
+	It("should extract the last of entries with the same name", func() {
+		outcome := assemble(&Processor{}, "twice.tar.gz", tarGzOf(entry{name: "a.txt", content: "first"}, entry{name: "a.txt", content: "second"}))
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(read("twice/a.txt")).To(Equal("second"))
+	})
+})
@@ -1,9 +1,14 @@
 package chunk
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
-
+	"path"
 	"sync"
+	"time"
 
 	"github.com/gotgo/fw/logging"
 	"github.com/gotgo/fw/me"
@@ -12,6 +17,12 @@ import (
 // FileAssembler - assembles file chunks into files
 type FileAssembler struct {
 	Log logging.Logger `inject:""`
+	// Observer - optional, notified when assemblies start and finish and when cleanup fails
+	Observer Observer
+	// ProgressInterval - minimum time between AssembleFolder.Progress events, defaults to one second
+	ProgressInterval time.Duration
+	// Pipeline - optional, processors run on every assembled file before its callback
+	Pipeline *Pipeline
 
 	// running - true if running
 	running bool
@@ -25,8 +36,18 @@ type FileAssembler struct {
 	closeToAssembleOnce *sync.Once
 	// mu - synchronize access to Start() and Stop()
 	mu sync.Mutex
+	// active - queued or running assemblies by identifier, so they can be cancelled
+	active map[string]*cancellation
+	// finished - outcome of the last assemblyHistory assemblies by identifier, oldest first in finishedOrder
+	finished      map[string]AssemblyStatus
+	finishedOrder []string
+	// activeMu - synchronize access to active and finished
+	activeMu sync.Mutex
 }
 
+// ErrAssemblyCancelled - the outcome error of an assembly stopped by Cancel
+var ErrAssemblyCancelled = errors.New("assembly cancelled")
+
 // Start - Start Threads to assemble files.
 func (fa *FileAssembler) Start() {
 	fa.mu.Lock()
@@ -74,20 +95,106 @@ func (fa *FileAssembler) completer() {
 }
 
 func (fa *FileAssembler) Post(folder *AssembleFolder) {
+	folder.cancel = &cancellation{done: make(chan struct{})}
+
+	fa.activeMu.Lock()
+	if fa.active == nil {
+		fa.active = make(map[string]*cancellation)
+	}
+	fa.active[folder.Source.key()] = folder.cancel
+	fa.activeMu.Unlock()
+
 	fa.toAssemble <- folder
 }
 
+// QueueDepth - number of folders posted and not yet picked up by an assembler
+func (fa *FileAssembler) QueueDepth() int {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return len(fa.toAssemble)
+}
+
+// Cancel - stop the queued or running assembly of identifier, SessionKey(tenant, identifier) for the sessions
+// of a tenant. The partial destination file and the chunks are deleted and the callback receives
+// ErrAssemblyCancelled. Returns false if nothing is being assembled under identifier.
+func (fa *FileAssembler) Cancel(identifier string) bool {
+	fa.activeMu.Lock()
+	defer fa.activeMu.Unlock()
+
+	c, ok := fa.active[identifier]
+	if ok {
+		c.cancel()
+	}
+	return ok
+}
+
+// Status - whether identifier is queued, running or finished, finished assemblies are remembered for a while.
+// Tenant sessions are looked up by SessionKey(tenant, identifier).
+func (fa *FileAssembler) Status(identifier string) AssemblyStatus {
+	fa.activeMu.Lock()
+	defer fa.activeMu.Unlock()
+
+	if c, ok := fa.active[identifier]; ok {
+		if c.running {
+			return AssemblyStatus{State: AssemblyRunning}
+		}
+		return AssemblyStatus{State: AssemblyQueued}
+	}
+	return fa.finished[identifier]
+}
+
+func (fa *FileAssembler) begin(a *AssembleFolder) {
+	fa.activeMu.Lock()
+	defer fa.activeMu.Unlock()
+	a.cancel.running = true
+}
+
+func (fa *FileAssembler) release(a *AssembleFolder) {
+	fa.activeMu.Lock()
+	defer fa.activeMu.Unlock()
+
+	identifier := a.Source.key()
+	if fa.active[identifier] == a.cancel {
+		delete(fa.active, identifier)
+	}
+
+	status := AssemblyStatus{State: AssemblyDone, Uri: a.uri}
+	if a.err == ErrAssemblyCancelled {
+		status = AssemblyStatus{State: AssemblyCancelled}
+	} else if a.err != nil {
+		status = AssemblyStatus{State: AssemblyFailed, Error: a.err.Error()}
+	}
+
+	if fa.finished == nil {
+		fa.finished = make(map[string]AssemblyStatus)
+	}
+	if _, ok := fa.finished[identifier]; !ok {
+		fa.finishedOrder = append(fa.finishedOrder, identifier)
+	}
+	fa.finished[identifier] = status
+	if len(fa.finishedOrder) > assemblyHistory {
+		delete(fa.finished, fa.finishedOrder[0])
+		fa.finishedOrder = fa.finishedOrder[1:]
+	}
+}
+
 func (fa *FileAssembler) runAssembler() {
+	observer := observerOrNop(fa.Observer)
 	for a := range fa.toAssemble {
-		a.uri, a.err = fa.doAssemble(a.Source, a.Destination)
-
-		fa.assembled <- a
+		fa.begin(a)
+		observer.AssemblyStarted(a)
+		a.uri, a.err = fa.doAssemble(a)
+		observer.AssemblyFinished(a, a.outcome())
 
 		//in either case: fail or succeed - delete everything so we can start fresh
 		err := a.Source.Remove()
 		if err != nil {
 			me.LogError(fa.Log, "failed to remove chunk source", err, &logging.KV{"source", a.uri})
+			observer.CleanupFailed(a.Source.Identifier, err)
 		}
+		//the status is final before the callback runs
+		fa.release(a)
+		fa.assembled <- a
 	}
 
 	fa.closeAssembledOnce.Do(func() {
@@ -95,55 +202,245 @@ func (fa *FileAssembler) runAssembler() {
 	})
 }
 
-func (fa *FileAssembler) doAssemble(folder *ChunkFolder, destination FolderDestination) (string, error) {
-	source, filename := folder, folder.Filename
+func (fa *FileAssembler) doAssemble(a *AssembleFolder) (string, error) {
+	source, destination := a.Source, a.Destination
+	if a.cancel.isCancelled() {
+		return "", ErrAssemblyCancelled
+	}
+
+	info, err := newUploadInfo(a)
+	if err != nil {
+		return "", err
+	}
+	a.contentType = info.ContentType
 
-	writer, err := destination.Create(filename)
+	filename, err := a.Naming.name(info)
+	if err != nil {
+		return "", me.Err(err, "failed to name destination file", &me.KV{"identifier", source.Identifier})
+	}
+
+	//a resolver may hand over to another, a Router rule pointing at a ContentStore
+	for i := 0; i < maxResolveDepth; i++ {
+		r, ok := destination.(Resolver)
+		if !ok {
+			break
+		}
+		next, name, err := r.Resolve(info, filename)
+		if err != nil {
+			return "", me.Err(err, "failed to route destination file", &me.KV{"identifier", source.Identifier})
+		}
+		filename = name
+		if next == destination {
+			break
+		}
+		destination = next
+	}
+
+	if d, ok := destination.(Deduplicator); ok {
+		found, err := d.Claim(filename)
+		if err != nil {
+			return "", me.Err(err, "failed to look up stored content", &me.KV{"filename", filename})
+		}
+		if found {
+			a.size, a.digest, a.deduplicated = info.Size, info.digest, true
+			uri := destination.Uri(filename)
+			if _, err = fa.process(a, info, destination, filename, filename, filename, uri, info.Size); err != nil {
+				return "", err
+			}
+			source.Remove()
+			return uri, nil
+		}
+	}
+
+	name := filename
+	if filename, err = a.Naming.avoidCollision(filename, destination); err != nil {
+		return "", me.Err(err, "failed to name destination file", &me.KV{"identifier", source.Identifier})
+	}
+
+	//a file the pipeline may still refuse is not published under its name before it passed, nor one that
+	//must not replace the file another upload publishes under it meanwhile
+	stored := filename
+	exclusive := a.Naming.Collision != CollisionOverwrite && canRenameExclusive(destination)
+	if exclusive || (fa.Pipeline != nil && canRename(destination)) {
+		stored = stagingName(filename)
+	}
+	writer, err := destination.Create(stored)
 
 	if err != nil || writer == nil {
-		return "", me.Err(err, "failed to create destination writer", &me.KV{"filename", filename})
+		return "", me.Err(err, "failed to create destination writer", &me.KV{"filename", stored})
 	}
 
-	if err = fa.assemble(source, writer); err != nil {
-		destination.Delete(filename) //cleanup
+	var progress *progressWriter
+	if a.Progress != nil {
+		progress = newProgressWriter(filename, a.Progress, fa.ProgressInterval)
+	}
+
+	digest := sha256.New()
+	size, err := fa.assemble(source, io.MultiWriter(writer, digest), progress, a.cancel.done)
+	if err != nil {
+		if !Discard(writer) {
+			fa.cleanup(a, destination, stored)
+		}
+		if a.cancel.isCancelled() {
+			return "", ErrAssemblyCancelled
+		}
 		return "", err
 	}
 
 	if err = writer.Close(); err != nil {
-		destination.Delete(filename) //delete on error
-		return "", me.Err(err, "failed to close writer", &me.KV{"filename", filename})
+		if LeftBehind(writer) {
+			fa.cleanup(a, destination, stored) //delete on error
+		}
+		return "", me.Err(err, "failed to close writer", &me.KV{"filename", stored})
+	}
+
+	a.size, a.digest = size, hex.EncodeToString(digest.Sum(nil))
+	uri := destination.Uri(filename)
+	if r, ok := writer.(ReplicaReporter); ok {
+		a.replicas = r.Replicas()
+		for _, replica := range a.replicas {
+			if replica.Err == nil {
+				uri = replica.Uri
+				break
+			}
+		}
+	}
+
+	published, err := fa.process(a, info, destination, stored, name, filename, uri, size)
+	if err != nil {
+		return "", err
+	}
+	if published != filename {
+		uri = destination.Uri(published)
 	}
 
 	//we are only removing on success, so we can see what failed? or should we always cleanup no matter what?
 	source.Remove()
-	return destination.Uri(filename), nil
+	return uri, nil
+}
+
+// process - run the pipeline on the file stored under the name stored, and publish it as filename, the name
+// the collision policy picked for name, once it passed. It is deleted when a stage fails, for a deduplicated
+// file that releases the reference taken on the stored copy. Returns the name the file was published under.
+func (fa *FileAssembler) process(a *AssembleFolder, info *UploadInfo, destination FolderDestination, stored, name, filename, uri string, size int64) (string, error) {
+	var f *ProcessedFile
+	if fa.Pipeline != nil {
+		f = &ProcessedFile{Info: info, Filename: filename, Uri: uri, Size: size, Digest: a.digest, Destination: destination, stored: stored}
+		if err := fa.Pipeline.run(a, f); err != nil {
+			fa.cleanup(a, destination, stored)
+			return "", err
+		}
+	}
+	if stored == filename {
+		return filename, nil
+	}
+
+	published, err := a.Naming.publish(destination, stored, name, filename)
+	if err != nil {
+		if f != nil {
+			f.removeDerived()
+		}
+		fa.cleanup(a, destination, stored)
+		return "", me.Err(err, "failed to publish assembled file", &me.KV{"filename", filename})
+	}
+	return published, nil
+}
+
+// stagingName - the name a file is assembled under until the pipeline passed it, hidden next to filename.
+// It has the form of a temp file, so FileDestination.SweepTemp removes it when a crash left it behind.
+func stagingName(filename string) string {
+	dir, base := path.Split(filename)
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	return dir + "." + base + ".tmp-" + hex.EncodeToString(suffix)
+}
+
+// cleanup - delete a partially written file
+func (fa *FileAssembler) cleanup(a *AssembleFolder, destination FolderDestination, filename string) {
+	if err := destination.Delete(filename); err != nil {
+		me.LogError(fa.Log, "failed to delete partial file", err, &logging.KV{"filename", filename})
+		observerOrNop(fa.Observer).CleanupFailed(a.Source.Identifier, err)
+	}
 }
 
-// assemble - folderPath: the folder of files to make into one file, returns: the file path of the completed file
-func (fa *FileAssembler) assemble(source *ChunkFolder, dst io.WriteCloser) error {
+// assemble - folderPath: the folder of files to make into one file, returns: the number of bytes written
+func (fa *FileAssembler) assemble(source *ChunkFolder, dst io.Writer, progress *progressWriter, cancelled <-chan struct{}) (int64, error) {
 	files, err := source.Files()
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	var out io.Writer = dst
+	var total int64
+	if progress != nil {
+		total, _ = sumSizes(files, nil)
+		out = io.MultiWriter(dst, progress)
 	}
 
 	//join multiple files into 1 file
-	for _, file := range files {
+	var written int64
+	for i, file := range files {
 		path := file.Uri()
+		if progress != nil {
+			progress.start(i+1, len(files), total)
+		}
 		src, err := file.Open()
 		if err != nil {
-			return me.Err(err, "Failed to open file", &me.KV{"file", path})
+			return written, me.Err(err, "Failed to open file", &me.KV{"file", path})
 		}
 		defer src.Close()
 
-		bts, err := io.Copy(dst, src)
+		bts, err := io.Copy(out, &cancelReader{src, cancelled})
 		if err != nil {
-			return me.Err(err, "copy fileChunk into destination stream failed", &me.KV{"fileChunkFile", path})
+			return written, me.Err(err, "copy fileChunk into destination stream failed", &me.KV{"fileChunkFile", path})
 		}
 
 		if bts == 0 {
-			return me.NewErr("no bytes copied", &me.KV{"fileChunkFile", path})
+			return written, me.NewErr("no bytes copied", &me.KV{"fileChunkFile", path})
 		}
+		written += bts
 	}
 
-	return nil
+	if progress != nil {
+		progress.finish()
+	}
+	return written, nil
+}
+
+// cancellation - signals a queued or running assembly to stop
+type cancellation struct {
+	done chan struct{}
+	once sync.Once
+	// running - an assembler picked it up, guarded by FileAssembler.activeMu
+	running bool
+}
+
+func (c *cancellation) cancel() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *cancellation) isCancelled() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// cancelReader - fails the copy loop as soon as the assembly is cancelled
+type cancelReader struct {
+	r         io.Reader
+	cancelled <-chan struct{}
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	select {
+	case <-c.cancelled:
+		return 0, ErrAssemblyCancelled
+	default:
+		return c.r.Read(p)
+	}
 }
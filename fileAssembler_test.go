@@ -0,0 +1,145 @@
+package chunk_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// EndlessFile - a chunk that never finishes copying
+type EndlessFile struct {
+	MockFile
+}
+
+func (f *EndlessFile) Open() (io.ReadCloser, error) {
+	return io.NopCloser(&endlessReader{}), nil
+}
+
+type endlessReader struct{}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+type EndlessFolder struct {
+	removed bool
+}
+
+func (f *EndlessFolder) Files() ([]FileSource, error) {
+	return []FileSource{&EndlessFile{}}, nil
+}
+
+func (f *EndlessFolder) Remove() error {
+	f.removed = true
+	return nil
+}
+
+type RecordingDestination struct {
+	MockDestination
+	deleted []string
+	written int64
+}
+
+func (d *RecordingDestination) Create(filename string) (io.WriteCloser, error) {
+	return d, nil
+}
+
+func (d *RecordingDestination) Write(p []byte) (int, error) {
+	atomic.AddInt64(&d.written, int64(len(p)))
+	return len(p), nil
+}
+
+func (d *RecordingDestination) Written() int64 {
+	return atomic.LoadInt64(&d.written)
+}
+
+func (d *RecordingDestination) Delete(filename string) error {
+	d.deleted = append(d.deleted, filename)
+	return nil
+}
+
+// AbortingDestination - its writer fails to close and drops the partial file itself
+type AbortingDestination struct {
+	RecordingDestination
+	aborted bool
+}
+
+func (d *AbortingDestination) Create(filename string) (io.WriteCloser, error) {
+	return d, nil
+}
+
+func (d *AbortingDestination) Close() error {
+	d.aborted = true
+	return errors.New("disk full")
+}
+
+func (d *AbortingDestination) Abort() error {
+	d.aborted = true
+	return nil
+}
+
+var _ = Describe("FileAssembler", func() {
+
+	It("should cancel a running assembly", func() {
+		fa := &FileAssembler{}
+		fa.Start()
+		defer fa.Stop()
+
+		source := &EndlessFolder{}
+		dest := &RecordingDestination{}
+		outcomes := make(chan *UploadOutcome, 1)
+
+		fa.Post(&AssembleFolder{
+			Source:      &ChunkFolder{FolderSource: source, Identifier: "abcdefg", Filename: "abcdefg"},
+			Destination: dest,
+			Callback:    func(o *UploadOutcome) { outcomes <- o },
+		})
+
+		Eventually(dest.Written).Should(BeNumerically(">", 0)) //cancel while copying
+		Expect(fa.Cancel("abcdefg")).To(BeTrue())
+
+		var outcome *UploadOutcome
+		Eventually(outcomes).Should(Receive(&outcome))
+		Expect(outcome.Err).To(Equal(ErrAssemblyCancelled))
+		Expect(fa.Cancel("abcdefg")).To(BeFalse())
+		Expect(source.removed).To(BeTrue())
+		Expect(dest.deleted).To(Equal([]string{"abcdefg"})) //the partial file
+		Expect(fa.Status("abcdefg").State).To(Equal(AssemblyCancelled))
+	})
+
+	It("should not delete the previous file when an aborting writer fails to close", func() {
+		folder, _ := ioutil.TempDir("", "assembler")
+		defer os.RemoveAll(folder)
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 2, ChunkSize: 2, TotalSize: 2, TotalChunks: 1,
+			Identifier: "report", Filename: "report.csv", Destination: &FileDestination{FolderRoot: folder}}
+		source, err := u.UploadChunk(strings.NewReader("v2"))
+		Expect(err).NotTo(HaveOccurred())
+
+		dest := &AbortingDestination{}
+		fa := &FileAssembler{}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *UploadOutcome, 1)
+		fa.Post(&AssembleFolder{Source: source, Destination: dest, Callback: func(o *UploadOutcome) { outcomes <- o }})
+
+		var o *UploadOutcome
+		Eventually(outcomes).Should(Receive(&o))
+		Expect(o.Err).NotTo(BeNil())
+		Expect(dest.aborted).To(BeTrue())
+		Expect(dest.deleted).To(BeEmpty())
+	})
+
+	It("should not cancel an unknown assembly", func() {
+		fa := &FileAssembler{}
+		Expect(fa.Cancel("unknown")).To(BeFalse())
+	})
+
+})
@@ -1,12 +1,18 @@
 package chunk
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gotgo/fw/me"
 	"github.com/gotgo/fw/util"
@@ -16,7 +22,16 @@ import (
 
 type FileDestination struct {
 	FolderRoot string
-	subfolder  string
+	//SpaceCheck - refuse sessions the filesystem of FolderRoot cannot hold, see Admit
+	SpaceCheck bool
+	//MinFreeSpace - bytes that must stay free once a session is admitted
+	MinFreeSpace int64
+	//AssemblySpace - also count room for the assembled file, when it is written to the same filesystem
+	AssemblySpace bool
+	//ShardLevels - spread session folders and assembled files over this many levels of hash prefix folders,
+	//zero keeps them all directly in FolderRoot. See MigrateSessions and MigrateFiles to convert a flat layout.
+	ShardLevels int
+	subfolder   string
 }
 
 func (f *FileDestination) Writer(subfolder string) FolderDestination {
@@ -28,20 +43,73 @@ func (f *FileDestination) Reader(subfolder string) FolderSource {
 }
 
 func (f *FileDestination) createCopy(subfolder string) *FileDestination {
-	return &FileDestination{FolderRoot: f.FolderRoot, subfolder: subfolder}
+	c := *f
+	c.subfolder = subfolder
+	return &c
 }
 
-func (f *FileDestination) getFolder() string {
-	return filepath.Join(util.NotEmpty(f.FolderRoot, "/tmp"), f.subfolder)
+func (f *FileDestination) root() string {
+	return util.NotEmpty(f.FolderRoot, "/tmp")
 }
 
-func (f *FileDestination) getDestinationFile(filePath string) string {
-	return filepath.Join(f.getFolder(), filePath)
+// getFolder - the subfolder below FolderRoot, an *UnsafePathError if it is not below it
+func (f *FileDestination) getFolder() (string, error) {
+	names := f.folderNames()
+	folder, err := resolveInside(f.root(), names...)
+	if err != nil || len(names) == 1 {
+		return folder, err
+	}
+
+	//a sharded subfolder must stay inside its shard
+	shardFolder, err := resolveInside(f.root(), names[:len(names)-1]...)
+	if err != nil {
+		return "", err
+	}
+	if !within(shardFolder, folder) || folder == shardFolder {
+		return "", &UnsafePathError{Root: f.root(), Path: f.subfolder, Reason: "not a folder in " + shardFolder}
+	}
+	return folder, nil
+}
+
+// getDestinationFile - the file in the subfolder, an *UnsafePathError if it is not inside the subfolder
+func (f *FileDestination) getDestinationFile(filePath string) (string, error) {
+	folder, err := f.getFolder()
+	if err != nil {
+		return "", err
+	}
+
+	names := f.folderNames()
+	if f.subfolder == "" && f.ShardLevels > 0 {
+		names = append(names, shard(filePath, f.ShardLevels)...)
+		if folder, err = resolveInside(f.root(), names...); err != nil {
+			return "", err
+		}
+	}
+
+	file, err := resolveInside(f.root(), append(names, filePath)...)
+	if err != nil {
+		return "", err
+	}
+	if !within(folder, file) || file == folder {
+		return "", &UnsafePathError{Root: f.root(), Path: filePath, Reason: "not a file in " + folder}
+	}
+	return file, nil
+}
+
+// folderNames - the path of the subfolder below FolderRoot, behind its shard folders when sharded
+func (f *FileDestination) folderNames() []string {
+	if f.subfolder == "" || f.ShardLevels <= 0 {
+		return []string{f.subfolder}
+	}
+	return append(shard(f.subfolder, f.ShardLevels), f.subfolder)
 }
 
 // Size() - Gets the file's size. If file doesn't exist, value is less than zero
 func (d *FileDestination) Size(filePath string) int64 {
-	path := d.getDestinationFile(filePath)
+	path, err := d.getDestinationFile(filePath)
+	if err != nil {
+		return -1
+	}
 	if fi, err := os.Stat(path); err == nil {
 		return fi.Size()
 	}
@@ -49,50 +117,143 @@ func (d *FileDestination) Size(filePath string) int64 {
 }
 
 func (d *FileDestination) Delete(filePath string) error {
-	path := d.getDestinationFile(filePath)
-	if path == "/" {
-		//ensure we are not deleting the whole system '/'
-		panic("wont delete whole filesystem")
+	path, err := d.getDestinationFile(filePath)
+	if err != nil {
+		return err
 	}
 	return os.Remove(path)
 }
 
+// Uri - the path of the file, empty if filename is not safe
 func (fd *FileDestination) Uri(filename string) string {
-	return fd.getDestinationFile(filename)
+	filePath, err := fd.getDestinationFile(filename)
+	if err != nil {
+		return ""
+	}
+	return filePath
 }
 
 func (fd *FileDestination) Create(filename string) (io.WriteCloser, error) {
-	folderRoot := path.Dir(fd.getDestinationFile(filename))
+	return fd.create(filename, false)
+}
+
+// CreateExclusive - like Create, but Close fails with ErrFileExists instead of replacing an existing file
+func (fd *FileDestination) CreateExclusive(filename string) (io.WriteCloser, error) {
+	return fd.create(filename, true)
+}
+
+func (fd *FileDestination) create(filename string, exclusive bool) (io.WriteCloser, error) {
+	filePath, err := fd.getDestinationFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	folderRoot := path.Dir(filePath)
 	if folderRoot != "" {
 		os.MkdirAll(folderRoot, 0774)
 	}
-	filePath := fd.Uri(filename)
 
-	file, err := os.Create(filePath)
+	//the folders just created could have raced with a symlink
+	if filePath, err = fd.getDestinationFile(filename); err != nil {
+		return nil, err
+	}
+
+	//write next to the final file, the chunk or assembled file only appears once it is complete
+	file, err := createTemp(filePath)
 	if err != nil {
 		return nil, me.Err(err, "create destination fail", &me.KV{"folderPath", filename}, &me.KV{"filePath", filePath})
 	}
-	return &FileFlusher{file}, nil
+	return &FileFlusher{file: file, path: filePath, exclusive: exclusive}, nil
+}
+
+// Rename - move the file from to to, replacing a file at to
+func (fd *FileDestination) Rename(from, to string) error {
+	return fd.rename(from, to, false)
+}
+
+// RenameExclusive - like Rename, but fails with ErrFileExists instead of replacing a file named to
+func (fd *FileDestination) RenameExclusive(from, to string) error {
+	return fd.rename(from, to, true)
+}
+
+func (fd *FileDestination) rename(from, to string, exclusive bool) error {
+	fromPath, err := fd.getDestinationFile(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := fd.getDestinationFile(to)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(toPath), 0774)
+
+	//the folders just created could have raced with a symlink
+	if toPath, err = fd.getDestinationFile(to); err != nil {
+		return err
+	}
+	if exclusive {
+		err = renameExclusive(fromPath, toPath)
+	} else {
+		err = os.Rename(fromPath, toPath)
+	}
+	if err == ErrFileExists {
+		return err
+	}
+	if err != nil {
+		return me.Err(err, "failed to rename file", &me.KV{"from", fromPath}, &me.KV{"to", toPath})
+	}
+	if err = syncDir(filepath.Dir(toPath)); err != nil {
+		return me.Err(err, "failed to flush destination folder to disk", &me.KV{"file", toPath})
+	}
+	return nil
+}
+
+// Open - read a file written to the subfolder
+func (fd *FileDestination) Open(filename string) (io.ReadCloser, error) {
+	filePath, err := fd.getDestinationFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return (&FileSystemFile{Path: filePath}).Open()
 }
 
 // Folder Source
 
+// Remove - remove the subfolder and everything in it, never FolderRoot itself
 func (f *FileDestination) Remove() error {
-	return os.RemoveAll(f.getFolder())
+	folder, err := f.getFolder()
+	if err != nil {
+		return err
+	}
+	if root, _ := filepath.Abs(f.root()); folder == root {
+		return &UnsafePathError{Root: f.root(), Path: f.subfolder, Reason: "is the root"}
+	}
+	return os.RemoveAll(folder)
 }
 
 func (f *FileDestination) Files() ([]FileSource, error) {
-	folderPath := f.getFolder()
+	folderPath, err := f.getFolder()
+	if err != nil {
+		return nil, err
+	}
 
 	fileInfos, err := ioutil.ReadDir(folderPath)
 	if err != nil {
 		return nil, me.Err(err, "read folder of chunk files fail", &me.KV{"folderPath", folderPath})
 	}
 
-	sort.Sort(ByChunk(fileInfos)) //sort the file names in the correct order for assembly
+	//only chunks, skip the session manifest and anything else stored in the folder
+	chunks := fileInfos[:0]
+	for _, fi := range fileInfos {
+		if _, err := strconv.Atoi(fi.Name()); err == nil && !fi.IsDir() {
+			chunks = append(chunks, fi)
+		}
+	}
+
+	sort.Sort(ByChunk(chunks)) //sort the file names in the correct order for assembly
 
-	source := make([]FileSource, len(fileInfos))
-	for i, fi := range fileInfos {
+	source := make([]FileSource, len(chunks))
+	for i, fi := range chunks {
 		filePath := path.Join(folderPath, fi.Name())
 		source[i] = &FileSystemFile{
 			Path: filePath,
@@ -101,6 +262,42 @@ func (f *FileDestination) Files() ([]FileSource, error) {
 	return source, nil
 }
 
+// tempName - the names createTemp gives, a dot, the final name and a random suffix
+var tempName = regexp.MustCompile(`^\..+\.tmp-[0-9a-f]{12}$`)
+
+// SweepTemp - remove the temp files of writers that never closed and the files staged by an assembly,
+// left behind by a crash, in the subfolder and below. Only files older than age are removed, it must be
+// longer than any write or pipeline takes. Returns how many were removed.
+func (f *FileDestination) SweepTemp(age time.Duration) (int, error) {
+	folder, err := f.getFolder()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().Add(-age)
+	removed := 0
+	err = filepath.Walk(folder, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || !tempName.MatchString(fi.Name()) || fi.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, me.Err(err, "failed to sweep temp files", &me.KV{"folder", folder})
+	}
+	return removed, nil
+}
+
 ////////////////////////////
 
 type FileSystemFile struct {
@@ -134,8 +331,15 @@ func (f *FileSystemFile) Open() (io.ReadCloser, error) {
 
 ////////////////////////////
 
+// FileFlusher - writes a temp file, Close flushes it to disk and renames it over path. The temp name is never
+// numeric so Files does not list it as a chunk.
 type FileFlusher struct {
 	file *os.File
+	//path - the final name, empty to write the file in place
+	path string
+	//exclusive - never replace an existing file at path
+	exclusive bool
+	aborted   bool
 }
 
 func (fd *FileFlusher) Write(b []byte) (int, error) {
@@ -150,16 +354,127 @@ func (fd *FileFlusher) Close() error {
 	if file == nil {
 		panic("no file to close")
 	}
+	if fd.aborted {
+		return me.NewErr("destination file aborted", &me.KV{"file", fd.path})
+	}
 
 	if err := file.Sync(); err != nil {
+		fd.Abort()
 		return me.Err(err, "failed to flush destination to disk", &me.KV{"file", file.Name()})
 	}
 
 	if err := file.Close(); err != nil {
+		fd.Abort()
 		return me.Err(err, "failed to close destination file", &me.KV{"file", file.Name()})
 	}
 
+	if fd.path == "" {
+		return nil
+	}
+	if err := fd.commit(); err != nil {
+		os.Remove(file.Name())
+		if err == ErrFileExists {
+			return err
+		}
+		return me.Err(err, "failed to commit destination file", &me.KV{"file", fd.path})
+	}
+	if err := syncDir(filepath.Dir(fd.path)); err != nil {
+		return me.Err(err, "failed to flush destination folder to disk", &me.KV{"file", fd.path})
+	}
+	return nil
+}
+
+// commit - move the temp file to path, an exclusive file only if path does not exist
+func (fd *FileFlusher) commit() error {
+	if !fd.exclusive {
+		return os.Rename(fd.file.Name(), fd.path)
+	}
+	return renameExclusive(fd.file.Name(), fd.path)
+}
+
+// renameExclusive - move from to to, ErrFileExists if to exists. It is hard linked, which fails if to exists,
+// and claimed with O_EXCL on filesystems without links.
+func renameExclusive(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil {
+		return os.Remove(from)
+	}
+	if os.IsExist(err) {
+		return ErrFileExists
+	}
+	claim, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return ErrFileExists
+	}
+	if err != nil {
+		return err
+	}
+	claim.Close()
+	return os.Rename(from, to)
+}
+
+// Abort - discard the temp file, the file at path is left as it was
+func (fd *FileFlusher) Abort() error {
+	if fd.aborted || fd.path == "" {
+		return nil
+	}
+	fd.aborted = true
+	fd.file.Close()
+	if err := os.Remove(fd.file.Name()); err != nil && !os.IsNotExist(err) {
+		return me.Err(err, "failed to remove temp file", &me.KV{"file", fd.file.Name()})
+	}
 	return nil
 }
 
+// createTemp - a new file named after filePath in the same folder, so the rename cannot cross devices
+func createTemp(filePath string) (*os.File, error) {
+	dir, base := filepath.Split(filePath)
+	for attempt := 0; ; attempt++ {
+		suffix := make([]byte, 6)
+		rand.Read(suffix)
+		name := filepath.Join(dir, "."+base+".tmp-"+hex.EncodeToString(suffix))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && attempt < 10 {
+			continue
+		}
+		return file, err
+	}
+}
+
+// WriteFileAtomic - replace filePath with b through a flushed temp file renamed over it, so a crash leaves
+// either the previous or the new content behind
+func WriteFileAtomic(filePath string, b []byte) error {
+	file, err := createTemp(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(b); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// syncDir - flush a folder so a rename in it survives a crash, folders cannot be flushed on windows
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
 ////////////////////////////
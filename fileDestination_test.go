@@ -0,0 +1,285 @@
+package chunk_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// sandbox - a FolderRoot inside parent, next to a sentinel file and with a symlink pointing back at parent
+func sandbox(parent string) (string, string) {
+	root := filepath.Join(parent, "root")
+	sentinel := filepath.Join(parent, "sentinel")
+	os.MkdirAll(root, 0774)
+	ioutil.WriteFile(sentinel, []byte("sentinel"), 0664)
+	os.Symlink(parent, filepath.Join(root, "link"))
+	return root, sentinel
+}
+
+// escaped - describes anything that changed outside of root, empty if nothing did
+func escaped(parent, sentinel string) string {
+	entries, err := ioutil.ReadDir(parent)
+	if err != nil {
+		return err.Error()
+	}
+	if len(entries) != 2 {
+		return "unexpected entries next to root"
+	}
+	if b, err := ioutil.ReadFile(sentinel); err != nil || string(b) != "sentinel" {
+		return "sentinel modified"
+	}
+	if fi, err := os.Stat(filepath.Join(parent, "root")); err != nil || !fi.IsDir() {
+		return "root removed"
+	}
+	return ""
+}
+
+var _ = Describe("FileDestination", func() {
+	var parent, root, sentinel string
+
+	BeforeEach(func() {
+		parent, _ = ioutil.TempDir("", "destination")
+		root, sentinel = sandbox(parent)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(parent)
+	})
+
+	It("should refuse names outside of the root", func() {
+		d := &FileDestination{FolderRoot: root}
+		for _, name := range []string{"../sentinel", "/etc/passwd", "a/../../sentinel", "link/sentinel", ""} {
+			_, err := d.Create(name)
+			Expect(IsUnsafePath(err)).To(BeTrue(), name)
+			Expect(IsUnsafePath(d.Delete(name))).To(BeTrue(), name)
+			Expect(d.Size(name)).To(BeNumerically("<", 0), name)
+		}
+		Expect(escaped(parent, sentinel)).To(BeEmpty())
+	})
+
+	It("should refuse subfolders outside of the root", func() {
+		d := &FileDestination{FolderRoot: root}
+		for _, subfolder := range []string{"..", "../root/..", "link", ""} {
+			Expect(IsUnsafePath(d.Reader(subfolder).Remove())).To(BeTrue(), subfolder)
+		}
+		Expect(escaped(parent, sentinel)).To(BeEmpty())
+	})
+
+	It("should write nested files inside the root", func() {
+		d := &FileDestination{FolderRoot: root}
+		w, err := d.Create("photos/2014/beach.jpg")
+		Expect(err).To(BeNil())
+		w.Write([]byte("jpg"))
+		Expect(w.Close()).To(BeNil())
+		Expect(d.Size("photos/2014/beach.jpg")).To(Equal(int64(3)))
+		Expect(d.Uri("photos/2014/beach.jpg")).To(HavePrefix(root))
+	})
+
+	It("should only show a file once it is closed", func() {
+		d := (&FileDestination{FolderRoot: root}).Writer("session")
+		w, err := d.Create("1")
+		Expect(err).To(BeNil())
+		w.Write([]byte("chunk"))
+		Expect(d.Size("1")).To(BeNumerically("<", 0))
+		files, _ := (&FileDestination{FolderRoot: root}).Reader("session").Files()
+		Expect(files).To(BeEmpty())
+
+		Expect(w.Close()).To(BeNil())
+		Expect(d.Size("1")).To(Equal(int64(5)))
+		entries, _ := ioutil.ReadDir(filepath.Join(root, "session"))
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("should leave the previous file when a write is aborted", func() {
+		d := &FileDestination{FolderRoot: root}
+		w, _ := d.Create("report.csv")
+		w.Write([]byte("v1"))
+		Expect(w.Close()).To(BeNil())
+
+		w, _ = d.Create("report.csv")
+		w.Write([]byte("partial v2"))
+		Expect(w.(Aborter).Abort()).To(BeNil())
+		b, _ := ioutil.ReadFile(filepath.Join(root, "report.csv"))
+		Expect(string(b)).To(Equal("v1"))
+		entries, _ := ioutil.ReadDir(root)
+		Expect(entries).To(HaveLen(2)) //link and report.csv
+	})
+
+	It("should sweep temp files left by writers that never closed", func() {
+		d := &FileDestination{FolderRoot: root}
+		w, _ := d.Writer("session").Create("1")
+		w.Write([]byte("crashed"))
+		d.Create("report.csv")
+		done, _ := d.Create("kept.csv")
+		Expect(done.Close()).To(BeNil())
+		ioutil.WriteFile(filepath.Join(root, ".kept.csv.tmp-notours"), []byte("other"), 0664)
+
+		removed, err := d.SweepTemp(time.Hour)
+		Expect(err).To(BeNil())
+		Expect(removed).To(Equal(0))
+
+		removed, err = d.SweepTemp(0)
+		Expect(err).To(BeNil())
+		Expect(removed).To(Equal(2))
+		entries, _ := ioutil.ReadDir(root)
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		Expect(names).To(ConsistOf("link", ".kept.csv.tmp-notours", "kept.csv", "session"))
+		entries, _ = ioutil.ReadDir(filepath.Join(root, "session"))
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should refuse sessions that do not fit on disk", func() {
+		d := &FileDestination{FolderRoot: root, SpaceCheck: true, MinFreeSpace: 1 << 62}
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 5, ChunkSize: 5, TotalSize: 10, TotalChunks: 2, Identifier: "big", Destination: d}
+		_, err := u.UploadChunk(bytes.NewReader([]byte("chunk")))
+		Expect(IsInsufficientSpace(err)).To(BeTrue())
+		_, err = os.Stat(filepath.Join(root, "big"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		d.MinFreeSpace = 0
+		_, err = u.UploadChunk(bytes.NewReader([]byte("chunk")))
+		Expect(err).To(BeNil())
+	})
+
+	It("should shard session folders and files, and migrate a flat layout", func() {
+		chunks, complete := filepath.Join(root, "incomplete"), filepath.Join(root, "complete")
+		w, _ := (&FileDestination{FolderRoot: chunks}).Writer("session").Create("1")
+		w.Write([]byte("chunk"))
+		w.Close()
+		w, _ = (&FileDestination{FolderRoot: complete}).Create("photos/beach.jpg")
+		w.Write([]byte("jpg"))
+		w.Close()
+
+		sessions := &FileDestination{FolderRoot: chunks, ShardLevels: 2}
+		Expect(sessions.Writer("session").Size("1")).To(BeNumerically("<", 0))
+		moved, err := sessions.MigrateSessions()
+		Expect(err).To(BeNil())
+		Expect(moved).To(Equal(1))
+		Expect(sessions.Writer("session").Size("1")).To(Equal(int64(5)))
+		files, err := sessions.Reader("session").Files()
+		Expect(err).To(BeNil())
+		Expect(files).To(HaveLen(1))
+
+		//a tenant's sessions are sharded by their whole key
+		key := SessionKey("acme", "session")
+		w, _ = (&FileDestination{FolderRoot: chunks}).Writer(key).Create("1")
+		w.Write([]byte("tenant"))
+		w.Close()
+		moved, err = sessions.MigrateSessions()
+		Expect(err).To(BeNil())
+		Expect(moved).To(Equal(1))
+		Expect(sessions.Writer(key).Size("1")).To(Equal(int64(6)))
+		Expect(sessions.Writer("session").Size("1")).To(Equal(int64(5)))
+		moved, _ = sessions.MigrateSessions()
+		Expect(moved).To(Equal(0))
+
+		completed := &FileDestination{FolderRoot: complete, ShardLevels: 2}
+		moved, err = completed.MigrateFiles()
+		Expect(err).To(BeNil())
+		Expect(moved).To(Equal(1))
+		Expect(completed.Size("photos/beach.jpg")).To(Equal(int64(3)))
+		rel, _ := filepath.Rel(complete, completed.Uri("photos/beach.jpg"))
+		Expect(strings.Split(rel, string(filepath.Separator))).To(HaveLen(4))
+		moved, _ = completed.MigrateFiles()
+		Expect(moved).To(Equal(0))
+
+		sharded := &FileDestination{FolderRoot: root, ShardLevels: 2}
+		for _, name := range []string{"..", "", "a/../.."} {
+			Expect(IsUnsafePath(sharded.Reader(name).Remove())).To(BeTrue(), name)
+			_, err = sharded.Create(name)
+			Expect(IsUnsafePath(err)).To(BeTrue(), name)
+		}
+		Expect(escaped(parent, sentinel)).To(BeEmpty())
+	})
+
+	It("should list only the chunks of a folder, in order", func() {
+		d := &FileDestination{FolderRoot: root}
+		folder := d.Writer("session")
+		for _, name := range []string{"10", "2", "1", "manifest.json", "notes"} {
+			w, err := folder.Create(name)
+			Expect(err).To(BeNil())
+			w.Write([]byte(name))
+			Expect(w.Close()).To(BeNil())
+		}
+		pending, err := folder.Create("3") //an uncommitted temp file
+		Expect(err).To(BeNil())
+		defer pending.Close()
+		os.MkdirAll(filepath.Join(root, "session", "4"), 0774)
+
+		files, err := d.Reader("session").Files()
+		Expect(err).To(BeNil())
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		Expect(names).To(Equal([]string{"1", "2", "10"}))
+	})
+
+	It("should create a file only once with CreateExclusive", func() {
+		d := &FileDestination{FolderRoot: root}
+		first, err := d.CreateExclusive("manifest.json")
+		Expect(err).To(BeNil())
+		second, err := d.CreateExclusive("manifest.json")
+		Expect(err).To(BeNil())
+
+		first.Write([]byte("first"))
+		second.Write([]byte("second"))
+		Expect(first.Close()).To(BeNil())
+		Expect(second.Close()).To(Equal(ErrFileExists))
+
+		b, _ := ioutil.ReadFile(filepath.Join(root, "manifest.json"))
+		Expect(string(b)).To(Equal("first"))
+		entries, _ := ioutil.ReadDir(root)
+		Expect(entries).To(HaveLen(2)) //the file and the link of the sandbox, no temp file left
+	})
+})
+
+func FuzzFileDestination(f *testing.F) {
+	seeds := [][2]string{
+		{"abcdefg", "1"},
+		{"abcdefg", "../../sentinel"},
+		{"..", "sentinel"},
+		{"link", "sentinel"},
+		{"", "/etc/passwd"},
+		{"a/../..", "x"},
+		{"", ""},
+		{"abcdefg", "link/sentinel"},
+		{`..\..`, `..\sentinel`},
+	}
+	for _, seed := range seeds {
+		f.Add(seed[0], seed[1])
+	}
+
+	f.Fuzz(func(t *testing.T, subfolder, name string) {
+		for _, levels := range []int{0, 2} {
+			parent := t.TempDir()
+			root, sentinel := sandbox(parent)
+			d := &FileDestination{FolderRoot: root, ShardLevels: levels}
+
+			if w, err := d.Writer(subfolder).Create(name); err == nil {
+				w.Write([]byte("x"))
+				w.Close()
+			}
+			d.Writer(subfolder).Size(name)
+			d.Writer(subfolder).Delete(name)
+			d.Reader(subfolder).Files()
+			d.Reader(subfolder).Remove()
+
+			if msg := escaped(parent, sentinel); msg != "" {
+				t.Fatalf("levels %d subfolder %q name %q: %s", levels, subfolder, name, msg)
+			}
+		}
+	})
+}
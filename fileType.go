@@ -0,0 +1,250 @@
+package chunk
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gotgo/fw/me"
+)
+
+// magic - a signature at an offset in the first bytes of a file
+type magic struct {
+	offset    int
+	signature string
+	mediaType string
+}
+
+// magics - formats http.DetectContentType does not know
+var magics = []magic{
+	{0, "II*\x00", "image/tiff"},
+	{0, "MM\x00*", "image/tiff"},
+	{0, "8BPS", "image/vnd.adobe.photoshop"},
+	{0, "FLV\x01", "video/x-flv"},
+	{0, "fLaC", "audio/flac"},
+	{0, "7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{0, "\xfd7zXZ\x00", "application/x-xz"},
+	{0, "\x28\xb5\x2f\xfd", "application/zstd"},
+	{257, "ustar", "application/x-tar"},
+}
+
+// brands - major brands of ISO media files (an "ftyp" box first) that are not plain mp4
+var brands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"hevc": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"qt  ": "video/quicktime",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3g2a": "video/3gpp2",
+	"M4A ": "audio/mp4",
+}
+
+// extensionTypes - what DetectContentType returns for the content of files with these extensions, where
+// that differs from the mime package or the mime package may not know it. Office documents are zip files.
+var extensionTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".avif": "image/avif",
+	".psd":  "image/vnd.adobe.photoshop",
+	".ico":  "image/x-icon",
+	".pdf":  "application/pdf",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".avi":  "video/avi",
+	".flv":  "video/x-flv",
+	".3gp":  "video/3gpp",
+	".3g2":  "video/3gpp2",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wave",
+	".flac": "audio/flac",
+	".ogg":  "application/ogg",
+	".zip":  "application/zip",
+	".docx": "application/zip",
+	".xlsx": "application/zip",
+	".pptx": "application/zip",
+	".odt":  "application/zip",
+	".epub": "application/zip",
+	".jar":  "application/zip",
+	".gz":   "application/x-gzip",
+	".tgz":  "application/x-gzip",
+	".tar":  "application/x-tar",
+	".7z":   "application/x-7z-compressed",
+	".xz":   "application/x-xz",
+	".bz2":  "application/x-bzip2",
+	".zst":  "application/zstd",
+	".svg":  "image/svg+xml",
+}
+
+// DetectContentType - the media type of a file from its first bytes, http.DetectContentType extended with
+// magic numbers of common image, video and archive formats. Looks at up to 512 bytes.
+func DetectContentType(head []byte) string {
+	if len(head) > sniffSize {
+		head = head[:sniffSize]
+	}
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		if t, ok := brands[string(head[8:12])]; ok {
+			return t
+		}
+	}
+	for _, m := range magics {
+		if len(head) >= m.offset+len(m.signature) && string(head[m.offset:m.offset+len(m.signature)]) == m.signature {
+			return m.mediaType
+		}
+	}
+	if bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")) && bytes.Contains(head, []byte("matroska")) {
+		return "video/x-matroska"
+	}
+	if len(head) >= 10 && string(head[:3]) == "BZh" && string(head[4:10]) == "1AY&SY" {
+		return "application/x-bzip2"
+	}
+
+	t := http.DetectContentType(head)
+	if (strings.HasPrefix(t, "text/xml") || strings.HasPrefix(t, "text/plain")) && bytes.Contains(head, []byte("<svg")) {
+		return "image/svg+xml"
+	}
+	return t
+}
+
+// extensionType - the media type the content of a file named filename should be detected as, empty when
+// the extension is unknown
+func extensionType(filename string) string {
+	ext := strings.ToLower(path.Ext(SanitizeFilename(filename)))
+	if ext == "" {
+		return ""
+	}
+	if t, ok := extensionTypes[ext]; ok {
+		return t
+	}
+	return mediaType(mime.TypeByExtension(ext))
+}
+
+// mediaType - t without parameters
+func mediaType(t string) string {
+	mt, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return t
+	}
+	return mt
+}
+
+// FileTypeError - an upload whose content is not an allowed type, or does not match its extension
+type FileTypeError struct {
+	Filename string
+	//Detected - the media type of the content
+	Detected string
+	//Expected - the media type of the extension, set for mismatches
+	Expected string
+}
+
+func (e *FileTypeError) Error() string {
+	if e.Expected != "" {
+		return "content of " + e.Filename + " is " + e.Detected + ", its extension says " + e.Expected
+	}
+	return "file type " + e.Detected + " not allowed"
+}
+
+// IsFileTypeError - true if err is a *FileTypeError
+func IsFileTypeError(err error) bool {
+	_, ok := err.(*FileTypeError)
+	return ok
+}
+
+// FileTypes - which detected content types an upload may have, checked on the first chunk before the
+// session is accepted. A session already started by a later chunk is aborted when the first one is refused,
+// and the refusal is kept in its manifest so the chunks that follow are refused as well.
+type FileTypes struct {
+	//Allow - media types accepted, "image/*" for a family, empty allows everything not denied
+	Allow []string
+	//Deny - media types refused even when Allow matches them
+	Deny []string
+	//RejectMismatch - refuse files whose flowFilename extension names another type than the content has.
+	//Unknown extensions and content detected as application/octet-stream are never a mismatch.
+	RejectMismatch bool
+
+	//restrict - further lists of media types, the type must match each of them, see Restrict
+	restrict [][]string
+}
+
+// Restrict - a copy of t that also refuses types not in allow, such as the types an upload token grants.
+// t may be nil, an empty allow returns t.
+func (t *FileTypes) Restrict(allow []string) *FileTypes {
+	if len(allow) == 0 {
+		return t
+	}
+	r := &FileTypes{}
+	if t != nil {
+		*r = *t
+	}
+	r.restrict = append(append([][]string(nil), r.restrict...), allow)
+	return r
+}
+
+func (t *FileTypes) check(detected, filename string) error {
+	if t == nil {
+		return nil
+	}
+	mt := mediaType(detected)
+	if MatchMediaType(t.Deny, mt) || (len(t.Allow) > 0 && !MatchMediaType(t.Allow, mt)) {
+		return &FileTypeError{Filename: filename, Detected: mt}
+	}
+	for _, allow := range t.restrict {
+		if !MatchMediaType(allow, mt) {
+			return &FileTypeError{Filename: filename, Detected: mt}
+		}
+	}
+	if t.RejectMismatch && mismatch(mt, extensionType(filename)) {
+		return &FileTypeError{Filename: filename, Detected: mt, Expected: extensionType(filename)}
+	}
+	return nil
+}
+
+// textTypes - formats without a signature that are detected as plain text
+var textTypes = []string{"text/*", "application/json", "application/xml", "application/javascript"}
+
+// mismatch - true if the detected type cannot be the expected one, plain text is any text format
+func mismatch(detected, expected string) bool {
+	if expected == "" || detected == "application/octet-stream" || strings.EqualFold(detected, expected) {
+		return false
+	}
+	return !(detected == "text/plain" && MatchMediaType(textTypes, expected))
+}
+
+// detectType - the content type of the first chunk and a reader still returning all of src. The type is
+// checked against FileTypes.
+func (u *ChunkUpload) detectType(src io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, me.Err(err, "failed to read start of chunk", &me.KV{"identifier", u.Identifier})
+	}
+	head = head[:n]
+
+	contentType := DetectContentType(head)
+	if err = u.FileTypes.check(contentType, u.Filename); err != nil {
+		return "", nil, err
+	}
+	return contentType, io.MultiReader(bytes.NewReader(head), src), nil
+}
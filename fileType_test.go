@@ -0,0 +1,107 @@
+package chunk_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileTypes", func() {
+	var folder string
+	var d *FileDestination
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "filetypes")
+		d = &FileDestination{FolderRoot: folder}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 24)...)
+	pdf := []byte("%PDF-1.4 and some more bytes...!")
+	types := &FileTypes{Allow: []string{"image/*", "application/pdf"}, RejectMismatch: true}
+
+	upload := func(number int, filename string, content []byte) (*ChunkUpload, error) {
+		u := &ChunkUpload{CurrentChunkNumber: number, CurrentChunkSize: 32, ChunkSize: 32, TotalSize: 64, TotalChunks: 2,
+			Identifier: "file", Filename: filename, Destination: d, FileTypes: types}
+		_, err := u.UploadChunk(bytes.NewReader(content))
+		return u, err
+	}
+
+	It("should detect formats the standard library does not know", func() {
+		Expect(DetectContentType(png)).To(Equal("image/png"))
+		Expect(DetectContentType([]byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"))).To(Equal("image/heic"))
+		Expect(DetectContentType([]byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"))).To(Equal("video/quicktime"))
+		Expect(DetectContentType([]byte("II*\x00\x08\x00\x00\x00"))).To(Equal("image/tiff"))
+		Expect(DetectContentType([]byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`))).To(Equal("image/svg+xml"))
+
+		tar := make([]byte, 512)
+		copy(tar[257:], "ustar")
+		Expect(DetectContentType(tar)).To(Equal("application/x-tar"))
+	})
+
+	It("should accept allowed types and record them in the manifest", func() {
+		u, err := upload(1, "scan.pdf", pdf)
+		Expect(err).NotTo(HaveOccurred())
+		status, err := u.Status()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Manifest.ContentType).To(Equal("application/pdf"))
+	})
+
+	It("should refuse types that are not allowed and extensions that do not match", func() {
+		_, err := upload(1, "notes.txt", []byte("just some text, nothing to see.."))
+		Expect(IsFileTypeError(err)).To(BeTrue())
+
+		_, err = upload(1, "photo.jpg", png)
+		Expect(IsFileTypeError(err)).To(BeTrue())
+		Expect(err.(*FileTypeError).Expected).To(Equal("image/jpeg"))
+	})
+
+	It("should abort a session started by a later chunk when the first is refused", func() {
+		u, err := upload(2, "photo.png", png)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = upload(1, "photo.png", pdf)
+		Expect(IsFileTypeError(err)).To(BeTrue())
+		status, err := u.Status()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Manifest.Rejected.Detected).To(Equal("application/pdf"))
+		Expect(status.Received).To(BeEmpty())
+	})
+
+	It("should refuse the later chunks of a session whose first chunk was refused", func() {
+		_, err := upload(1, "photo.png", pdf)
+		Expect(IsFileTypeError(err)).To(BeTrue())
+
+		u, err := upload(2, "photo.png", png)
+		Expect(IsFileTypeError(err)).To(BeTrue())
+		Expect(err.(*FileTypeError).Detected).To(Equal("application/pdf"))
+		status, err := u.Status()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Received).To(BeEmpty())
+
+		//aborting clears the rejection, the identifier can be used again
+		Expect(u.Abort()).To(Succeed())
+		_, err = upload(2, "photo.png", png)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should add the type to the manifest of a session a later chunk started", func() {
+		u, err := upload(2, "photo.png", png)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = upload(1, "photo.png", png)
+		Expect(err).NotTo(HaveOccurred())
+
+		status, err := u.Status()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Manifest.ContentType).To(Equal("image/png"))
+		Expect(status.Complete).To(BeTrue())
+	})
+})
@@ -11,6 +11,8 @@ import (
 )
 
 const formFileKey = "file"
+const hashKey = "flowHash"
+const tokenKey = "flowToken"
 
 //flowChunkNumber
 //flowChunkSize
@@ -23,60 +25,23 @@ const formFileKey = "file"
 
 const bufferSize = 1024*1024 + 4096
 
-func ChunkAlreadyUploaded(r *http.Request, d chunk.Destination) (bool, int, string) {
-	ul, missingField := FlowParse(r)
-	if missingField != "" {
-		return false, 400, "bad request - missing data " + missingField
-	}
-
-	ul.Destination = d
+// multipartOverhead - room for the form fields and part headers around a chunk of Limits.MaxChunkSize
+const multipartOverhead = 64 * 1024
 
-	exists := ul.ChunkAlreadyUploaded()
-	if !exists {
-		return false, 404, "not found"
-	} else {
-		return true, 200, "OK"
-	}
+func ChunkAlreadyUploaded(r *http.Request, d chunk.Destination) (bool, int, string) {
+	h := &Handler{Destination: d}
+	return h.ChunkAlreadyUploaded(r)
 }
 
 func UploadChunk(r *http.Request, d chunk.Destination) (*chunk.ChunkFolder, int, string, error) {
-	u, missingField := FlowParse(r)
-	if missingField != "" {
-		return nil, 400, "bad request - missing data " + missingField, nil
-	}
-
-	u.Destination = d
-
-	r.ParseMultipartForm(bufferSize)
-
-	if r.MultipartForm == nil {
-		return nil, 400, "bad request - no multipart form", nil
-	}
-
-	if r.MultipartForm.File == nil {
-		return nil, 400, "no files in multipart form", nil
-	}
-
-	files := r.MultipartForm.File[formFileKey]
-
-	if len(files) > 1 {
-		return nil, 400, "more than 1 file present for key " + formFileKey, nil
-	} else if len(files) == 0 {
-		return nil, 400, "no file found at multipart key:" + formFileKey, nil
-	}
-
-	f, err := files[0].Open()
-	if err != nil {
-		return nil, 500, "failed to open the submitted file", err
-	}
-	defer f.Close()
-	folder, err := u.UploadChunk(f)
-
-	if err != nil {
-		return nil, 500, "failed to upload file", err
-	}
+	h := &Handler{Destination: d}
+	return h.UploadChunk(r)
+}
 
-	return folder, 200, "OK", nil
+// AbortUpload - remove the chunks of the upload session named by flowIdentifier, meant for an http DELETE
+func AbortUpload(r *http.Request, d chunk.Destination) (int, string, error) {
+	h := &Handler{Destination: d}
+	return h.AbortUpload(r)
 }
 
 func FlowParse(r *http.Request) (*chunk.ChunkUpload, string) {
@@ -103,16 +68,9 @@ func FlowParse(r *http.Request) (*chunk.ChunkUpload, string) {
 		return nil, "flowTotalSize"
 	}
 
-	flowIdentifier := r.FormValue("flowIdentifier")
-
-	safe, index := util.IsPathSafe(flowIdentifier)
-	if !safe {
-		return nil, fmt.Sprintf("flowIdentifier invalid character at index %d", index)
-	}
-
-	u.Identifier = flowIdentifier
-	if u.Identifier == "" {
-		return nil, "flowIdentifier"
+	var missingField string
+	if u.Identifier, missingField = parseIdentifier(r); missingField != "" {
+		return nil, missingField
 	}
 
 	u.Filename = r.FormValue("flowFilename")
@@ -122,7 +80,38 @@ func FlowParse(r *http.Request) (*chunk.ChunkUpload, string) {
 	if err != nil {
 		return nil, "flowTotalChunks"
 	}
-	return u, ""
+	return u, invalidField(u)
+}
+
+// invalidField - the first value that cannot describe a chunk of an upload, empty if they all can
+func invalidField(u *chunk.ChunkUpload) string {
+	switch {
+	case u.ChunkSize <= 0:
+		return "flowChunkSize invalid"
+	case u.TotalSize < 0:
+		return "flowTotalSize invalid"
+	case u.TotalChunks < 1:
+		return "flowTotalChunks invalid"
+	case u.CurrentChunkNumber < 1 || u.CurrentChunkNumber > u.TotalChunks:
+		return "flowChunkNumber invalid"
+	case u.CurrentChunkSize < 0 || int64(u.CurrentChunkSize) > u.TotalSize:
+		return "flowCurrentChunkSize invalid"
+	}
+	return ""
+}
+
+func parseIdentifier(r *http.Request) (string, string) {
+	flowIdentifier := r.FormValue("flowIdentifier")
+
+	safe, index := util.IsPathSafe(flowIdentifier)
+	if !safe {
+		return "", fmt.Sprintf("flowIdentifier invalid character at index %d", index)
+	}
+
+	if flowIdentifier == "" {
+		return "", "flowIdentifier"
+	}
+	return flowIdentifier, ""
 }
 
 //http util
@@ -0,0 +1,359 @@
+package flow
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/chunk/ratelimit"
+	"github.com/gotgo/chunk/token"
+	"github.com/gotgo/fw/me"
+)
+
+// Handler - the flow.js endpoints for one chunk Destination
+type Handler struct {
+	Destination chunk.Destination
+	//Observer - optional, passed on to every ChunkUpload and told about requests rejected before upload
+	Observer chunk.Observer
+	//Content - optional, lets clients skip uploads that are already stored, see ContentExists and CompleteByHash
+	Content *chunk.ContentStore
+	//Assembler - optional, adds the assembly state to Status and lets AbortUpload cancel a running assembly
+	Assembler *chunk.FileAssembler
+	//Tokens - optional, every request must carry an upload token signed by it, as flowToken or a Bearer
+	//Authorization header, and stay inside its grant. Content types the grant does not allow are detected
+	//from the first chunk and answered with 415.
+	Tokens *token.Signer
+	//Limits - optional, caps on sizes and tenant quotas, violations are answered with 413 or 429
+	Limits *chunk.Limits
+	//FileTypes - optional, content types accepted, detected from the first chunk and answered with 415 otherwise
+	FileTypes *chunk.FileTypes
+	//Identity - optional, the user or tenant making the request. Sessions, manifests and assembled files are
+	//namespaced by it, so identifiers only have to be unique per tenant. Without it the tenant of the upload
+	//token is used, if any.
+	Identity func(r *http.Request) (string, error)
+	//RateLimit - optional, request budgets checked by Throttle and byte budgets the body of a chunk request is
+	//read at. A request whose context ends while it waits is answered with 408.
+	RateLimit *ratelimit.Limiter
+	//ClientKey - optional, what RateLimit budgets are kept per, defaults to the remote IP. Behind a proxy
+	//read the forwarded address here.
+	ClientKey func(r *http.Request) string
+}
+
+// Throttle - call first for every request. When the client or the server is over its request budget a 429
+// with Retry-After is written and false returned, the request must not be handled then.
+func (h *Handler) Throttle(w http.ResponseWriter, r *http.Request) bool {
+	err := h.RateLimit.Allow(h.clientKey(r))
+	if err == nil {
+		return true
+	}
+	le := err.(*ratelimit.LimitedError)
+	w.Header().Set("Retry-After", strconv.FormatInt(ratelimit.RetryAfterSeconds(le.RetryAfter), 10))
+	w.WriteHeader(429)
+	w.Write([]byte("too many requests - " + err.Error()))
+	return false
+}
+
+func (h *Handler) clientKey(r *http.Request) string {
+	if h.ClientKey != nil {
+		return h.ClientKey(r)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (h *Handler) ChunkAlreadyUploaded(r *http.Request) (bool, int, string) {
+	ul, missingField := FlowParse(r)
+	if missingField != "" {
+		return false, 400, "bad request - missing data " + missingField
+	}
+	tenant, _, code, msg := h.authorize(r, ul.Identifier)
+	if code != 0 {
+		return false, code, msg
+	}
+
+	ul.Tenant = tenant
+	ul.Destination = h.Destination
+
+	exists := ul.ChunkAlreadyUploaded()
+	if !exists {
+		return false, 404, "not found"
+	} else {
+		return true, 200, "OK"
+	}
+}
+
+func (h *Handler) UploadChunk(r *http.Request) (*chunk.ChunkFolder, int, string, error) {
+	//refuse an oversized body while parsing it, not after it was buffered, and read it at the byte budget
+	if h.Limits != nil && h.Limits.MaxChunkSize > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, int64(h.Limits.MaxChunkSize)+multipartOverhead)
+	}
+	if h.RateLimit != nil {
+		r.Body = &body{Reader: h.RateLimit.Reader(r.Context(), h.clientKey(r), r.Body), Closer: r.Body}
+	}
+	if err := r.ParseMultipartForm(bufferSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return h.reject(nil, 413, "request entity too large - chunk larger than "+strconv.Itoa(h.Limits.MaxChunkSize)+" bytes")
+		}
+		if r.Context().Err() != nil {
+			return h.reject(nil, 408, "request timeout - "+r.Context().Err().Error())
+		}
+	}
+
+	u, missingField := FlowParse(r)
+	if missingField != "" {
+		return h.reject(nil, 400, "bad request - missing data "+missingField)
+	}
+	tenant, grant, code, msg := h.authorize(r, u.Identifier)
+	if code != 0 {
+		return h.reject(u, code, msg)
+	}
+
+	u.Tenant = tenant
+	u.Destination = h.Destination
+	u.Observer = h.Observer
+	u.Limits = h.Limits
+	u.FileTypes = h.FileTypes
+
+	if r.MultipartForm == nil {
+		return h.reject(u, 400, "bad request - no multipart form")
+	}
+
+	if r.MultipartForm.File == nil {
+		return h.reject(u, 400, "no files in multipart form")
+	}
+
+	files := r.MultipartForm.File[formFileKey]
+
+	if len(files) > 1 {
+		return h.reject(u, 400, "more than 1 file present for key "+formFileKey)
+	} else if len(files) == 0 {
+		return h.reject(u, 400, "no file found at multipart key:"+formFileKey)
+	}
+
+	if grant != nil {
+		if err := grant.Allows(u, ""); err != nil {
+			return h.reject(u, 403, "forbidden - "+err.Error())
+		}
+		//the declared part type is the client's word, the grant's types are checked on the detected one
+		u.FileTypes = h.FileTypes.Restrict(grant.ContentTypes)
+	}
+
+	f, err := files[0].Open()
+	if err != nil {
+		return nil, 500, "failed to open the submitted file", err
+	}
+	defer f.Close()
+	folder, err := u.UploadChunk(f)
+
+	if chunk.IsFileTypeError(err) {
+		return nil, 415, "unsupported media type - " + err.Error(), err
+	}
+	if chunk.IsInsufficientSpace(err) {
+		return nil, 507, "insufficient storage", err
+	}
+	if le, ok := err.(*chunk.LimitError); ok {
+		if le.Limit == chunk.LimitSessions {
+			return nil, 429, "too many requests - " + le.Error(), err
+		}
+		return nil, 413, "request entity too large - " + le.Error(), err
+	}
+	if err != nil {
+		return nil, 500, "failed to upload file", err
+	}
+
+	return folder, 200, "OK", nil
+}
+
+// body - a request body read through another reader
+type body struct {
+	io.Reader
+	io.Closer
+}
+
+// AbortUpload - remove the chunks of the upload session named by flowIdentifier, meant for an http DELETE
+func (h *Handler) AbortUpload(r *http.Request) (int, string, error) {
+	identifier, missingField := parseIdentifier(r)
+	if missingField != "" {
+		return 400, "bad request - missing data " + missingField, nil
+	}
+	tenant, _, code, msg := h.authorize(r, identifier)
+	if code != 0 {
+		return code, msg, nil
+	}
+
+	//stop the assembly in case the last chunk already arrived
+	if h.Assembler != nil {
+		h.Assembler.Cancel(chunk.SessionKey(tenant, identifier))
+	}
+
+	u := &chunk.ChunkUpload{Identifier: identifier, Tenant: tenant, Destination: h.Destination, Limits: h.Limits}
+	if err := u.Abort(); err != nil {
+		return 500, "failed to abort upload", err
+	}
+	return 200, "OK", nil
+}
+
+// Status - the chunks received and missing for the session named by flowIdentifier, so a resuming client
+// can upload only what is missing instead of probing every chunk. 404 when nothing is known about it.
+func (h *Handler) Status(r *http.Request) (*chunk.SessionStatus, int, string, error) {
+	identifier, missingField := parseIdentifier(r)
+	if missingField != "" {
+		return nil, 400, "bad request - missing data " + missingField, nil
+	}
+	tenant, _, code, msg := h.authorize(r, identifier)
+	if code != 0 {
+		return nil, code, msg, nil
+	}
+
+	u := &chunk.ChunkUpload{Identifier: identifier, Tenant: tenant, Destination: h.Destination}
+	status, err := u.Status()
+	if err != nil {
+		return nil, 500, "failed to read upload status", err
+	}
+	if h.Assembler != nil {
+		status.Assembly = h.Assembler.Status(chunk.SessionKey(tenant, identifier))
+	}
+
+	if status.Manifest == nil && len(status.Received) == 0 && status.Assembly.State == chunk.AssemblyUnknown {
+		return nil, 404, "not found", nil
+	}
+	return status, 200, "OK", nil
+}
+
+// ContentExists - for clients that send the hex sha256 of the whole file as flowHash before uploading.
+// When Content already stores it for the tenant of the request its uri is returned with a 200, 404 when it
+// is not stored. Nothing changes, the client skips the upload with CompleteByHash.
+func (h *Handler) ContentExists(r *http.Request) (string, int, string, error) {
+	tenant, digest, code, msg := h.contentDigest(r)
+	if code != 0 {
+		return "", code, msg, nil
+	}
+
+	uri, found, err := h.Content.Lookup(tenant, digest)
+	if err != nil {
+		return "", 500, "failed to look up content", err
+	}
+	if !found {
+		return "", 404, "not found", nil
+	}
+	return uri, 200, "OK", nil
+}
+
+// CompleteByHash - completes the session with the content Content already stores under flowHash, instead
+// of uploading it. A reference is taken on the stored copy and its uri returned with a 200, 404 when it is
+// not stored and the file has to be uploaded.
+func (h *Handler) CompleteByHash(r *http.Request) (string, int, string, error) {
+	tenant, digest, code, msg := h.contentDigest(r)
+	if code != 0 {
+		return "", code, msg, nil
+	}
+
+	key := chunk.ContentKey(tenant, digest)
+	found, err := h.Content.Claim(key)
+	if err != nil {
+		return "", 500, "failed to reference content", err
+	}
+	if !found {
+		return "", 404, "not found", nil
+	}
+	return h.Content.Uri(key), 200, "OK", nil
+}
+
+// contentDigest - the tenant and the flowHash of an authorized request, a non zero code if it is refused
+func (h *Handler) contentDigest(r *http.Request) (string, string, int, string) {
+	if h.Content == nil {
+		return "", "", 404, "not found"
+	}
+	identifier, missingField := parseIdentifier(r)
+	if missingField != "" {
+		return "", "", 400, "bad request - missing data " + missingField
+	}
+	tenant, _, code, msg := h.authorize(r, identifier)
+	if code != 0 {
+		return "", "", code, msg
+	}
+
+	digest := r.FormValue(hashKey)
+	if digest == "" {
+		return "", "", 400, "bad request - missing data " + hashKey
+	}
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return "", "", 400, "bad request - " + hashKey + " is not a hex sha256"
+	}
+	return tenant, digest, 0, ""
+}
+
+// Grant - the verified grant of the request's upload token, so the application can pick the destination it
+// names. Nil with a zero code when Tokens is not set.
+func (h *Handler) Grant(r *http.Request) (*token.Grant, int, string) {
+	identifier, missingField := parseIdentifier(r)
+	if missingField != "" {
+		return nil, 400, "bad request - missing data " + missingField
+	}
+	_, grant, code, msg := h.authorize(r, identifier)
+	return grant, code, msg
+}
+
+// Tenant - the tenant the request's sessions are namespaced by, empty when there is none
+func (h *Handler) Tenant(r *http.Request) (string, int, string) {
+	identifier, missingField := parseIdentifier(r)
+	if missingField != "" {
+		return "", 400, "bad request - missing data " + missingField
+	}
+	tenant, _, code, msg := h.authorize(r, identifier)
+	return tenant, code, msg
+}
+
+// authorize - the tenant of the request and the grant of its upload token, a non zero code when the request
+// is not allowed to touch identifier
+func (h *Handler) authorize(r *http.Request, identifier string) (string, *token.Grant, int, string) {
+	var tenant string
+	if h.Identity != nil {
+		var err error
+		if tenant, err = h.Identity(r); err != nil {
+			return "", nil, 401, "unauthorized - " + err.Error()
+		}
+	}
+	if h.Tokens == nil {
+		return tenant, nil, 0, ""
+	}
+
+	t := r.FormValue(tokenKey)
+	if auth := r.Header.Get("Authorization"); t == "" && strings.HasPrefix(auth, "Bearer ") {
+		t = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if t == "" {
+		return "", nil, 401, "unauthorized - missing " + tokenKey
+	}
+
+	grant, err := h.Tokens.Verify(t)
+	if err != nil {
+		return "", nil, 401, "unauthorized - " + err.Error()
+	}
+	if grant.Identifier != identifier {
+		return "", nil, 403, "forbidden - upload token is for another identifier"
+	}
+	if h.Identity == nil {
+		tenant = grant.Tenant
+	} else if grant.Tenant != "" && grant.Tenant != tenant {
+		return "", nil, 403, "forbidden - upload token is for another tenant"
+	}
+	return tenant, grant, 0, ""
+}
+
+// reject - tell the observer about a chunk refused before it reached ChunkUpload.UploadChunk
+func (h *Handler) reject(u *chunk.ChunkUpload, code int, msg string) (*chunk.ChunkFolder, int, string, error) {
+	if h.Observer != nil {
+		h.Observer.ChunkRejected(u, me.NewErr(msg))
+	}
+	return nil, code, msg, nil
+}
@@ -0,0 +1,197 @@
+package flow_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/flow"
+	"github.com/gotgo/chunk/ratelimit"
+	"github.com/gotgo/chunk/token"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// chunkRequest - a flow.js POST of chunk number of an upload of total bytes in chunks of len(content)
+func chunkRequest(identifier string, number, chunks int, total int64, content []byte) *http.Request {
+	return declaredRequest(identifier, number, chunks, total, content, "application/octet-stream")
+}
+
+// declaredRequest - a chunkRequest whose file part claims contentType
+func declaredRequest(identifier string, number, chunks int, total int64, content []byte, contentType string) *http.Request {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"flowChunkNumber":      strconv.Itoa(number),
+		"flowChunkSize":        strconv.Itoa(len(content)),
+		"flowCurrentChunkSize": strconv.Itoa(len(content)),
+		"flowTotalSize":        strconv.FormatInt(total, 10),
+		"flowTotalChunks":      strconv.Itoa(chunks),
+		"flowIdentifier":       identifier,
+		"flowFilename":         identifier + ".txt",
+	}
+	for k, v := range fields {
+		w.WriteField(k, v)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+identifier+`.txt"`)
+	header.Set("Content-Type", contentType)
+	part, _ := w.CreatePart(header)
+	part.Write(content)
+	w.Close()
+
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", w.FormDataContentType())
+	return r
+}
+
+var _ = Describe("Handler", func() {
+	var folder string
+	var chunks *chunk.FileDestination
+	var h *Handler
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "flow")
+		chunks = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		h = &Handler{Destination: chunks}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	It("should remove the chunks of an aborted upload", func() {
+		_, code, msg, err := h.UploadChunk(chunkRequest("doc", 1, 2, 8, []byte("half")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(code).To(Equal(200), msg)
+		folder := filepath.Join(chunks.FolderRoot, "doc")
+		Expect(folder).To(BeADirectory())
+
+		code, msg, err = h.AbortUpload(httptest.NewRequest("DELETE", "/upload?"+url.Values{"flowIdentifier": {"doc"}}.Encode(), nil))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(code).To(Equal(200), msg)
+		_, err = os.Stat(folder)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		status := &chunk.ChunkUpload{Identifier: "doc", Destination: chunks}
+		Expect(status.ChunkAlreadyUploaded()).To(BeFalse())
+	})
+
+	It("should refuse an oversized body while parsing it", func() {
+		h.Limits = &chunk.Limits{MaxChunkSize: 4}
+		_, code, msg, _ := h.UploadChunk(chunkRequest("doc", 1, 1, 1<<20, bytes.Repeat([]byte("text"), 1<<18)))
+		Expect(code).To(Equal(413))
+		Expect(msg).To(ContainSubstring("chunk larger than 4 bytes"))
+
+		_, code, msg, _ = h.UploadChunk(chunkRequest("doc", 1, 1, 4, []byte("text")))
+		Expect(code).To(Equal(200), msg)
+	})
+
+	It("should read the body at the byte budget while parsing it", func() {
+		h.RateLimit = &ratelimit.Limiter{Bytes: ratelimit.Budget{Rate: 100, Burst: 100}}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		r := chunkRequest("doc", 1, 1, 4096, bytes.Repeat([]byte("text"), 1024)).WithContext(ctx)
+
+		start := time.Now()
+		_, code, msg, _ := h.UploadChunk(r)
+		Expect(code).To(Equal(408), msg)
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		_, err := os.Stat(filepath.Join(chunks.FolderRoot, "doc"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should answer refused chunks with their status code", func() {
+		signer := &token.Signer{Secret: []byte("secret")}
+		small, _ := signer.Sign(&token.Grant{Identifier: "doc", MaxSize: 2, Expires: time.Now().Add(time.Hour)})
+		images, _ := signer.Sign(&token.Grant{Identifier: "doc", ContentTypes: []string{"image/*"}, Expires: time.Now().Add(time.Hour)})
+		declared := declaredRequest("doc", 1, 1, 4, []byte("text"), "image/png")
+		busy := &chunk.Limits{MaxSessions: 1}
+		_, code, _, _ := (&Handler{Destination: chunks, Limits: busy}).UploadChunk(chunkRequest("first", 1, 2, 8, []byte("half")))
+		Expect(code).To(Equal(200))
+
+		missing := chunkRequest("doc", 1, 1, 4, []byte("text"))
+		missing.Header.Set("Content-Type", "multipart/form-data; boundary=none")
+		bearer := func(r *http.Request, t string) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+t)
+			return r
+		}
+
+		cases := []struct {
+			handler *Handler
+			request *http.Request
+			code    int
+		}{
+			{&Handler{Destination: chunks}, missing, 400},
+			{&Handler{Destination: chunks, Identity: func(r *http.Request) (string, error) { return "", errors.New("no session") }},
+				chunkRequest("doc", 1, 1, 4, []byte("text")), 401},
+			{&Handler{Destination: chunks, Tokens: signer}, chunkRequest("doc", 1, 1, 4, []byte("text")), 401},
+			{&Handler{Destination: chunks, Tokens: signer}, bearer(chunkRequest("doc", 1, 1, 4, []byte("text")), small), 403},
+			{&Handler{Destination: chunks, Limits: &chunk.Limits{MaxFileSize: 2}}, chunkRequest("doc", 1, 1, 4, []byte("text")), 413},
+			{&Handler{Destination: chunks, FileTypes: &chunk.FileTypes{Allow: []string{"image/*"}}},
+				chunkRequest("doc", 1, 1, 4, []byte("text")), 415},
+			{&Handler{Destination: chunks, Tokens: signer}, bearer(declared, images), 415},
+			{&Handler{Destination: chunks, Limits: busy}, chunkRequest("second", 1, 2, 8, []byte("half")), 429},
+			{&Handler{Destination: &chunk.FileDestination{FolderRoot: chunks.FolderRoot, SpaceCheck: true, MinFreeSpace: 1 << 62}},
+				chunkRequest("doc", 1, 1, 4, []byte("text")), 507},
+		}
+		for i, c := range cases {
+			_, code, msg, _ := c.handler.UploadChunk(c.request)
+			Expect(code).To(Equal(c.code), "case %d: %s", i, msg)
+			//a refused type is kept for the session, the next case starts over
+			Expect((&chunk.ChunkUpload{Identifier: "doc", Destination: chunks}).Abort()).To(Succeed())
+		}
+	})
+
+	It("should look up content for the tenant of the request without referencing it", func() {
+		store := &chunk.ContentStore{Destination: &chunk.FileDestination{FolderRoot: filepath.Join(folder, "complete")}}
+		content := []byte("stored once")
+		digest := sha256.Sum256(content)
+		key := chunk.ContentKey("acme", hex.EncodeToString(digest[:]))
+		w, err := store.Create(key)
+		Expect(err).NotTo(HaveOccurred())
+		w.Write(content)
+		Expect(w.Close()).To(Succeed())
+
+		tenant := "acme"
+		h.Content = store
+		h.Identity = func(r *http.Request) (string, error) { return tenant, nil }
+		probe := func() *http.Request {
+			return httptest.NewRequest("GET", "/upload?"+url.Values{"flowIdentifier": {"doc"}, "flowHash": {hex.EncodeToString(digest[:])}}.Encode(), nil)
+		}
+
+		uri, code, msg, err := h.ContentExists(probe())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(code).To(Equal(200), msg)
+		Expect(uri).To(Equal(store.Uri(key)))
+		Expect(store.Index.Count(key)).To(Equal(1))
+
+		_, code, _, _ = h.CompleteByHash(probe())
+		Expect(code).To(Equal(200))
+		Expect(store.Index.Count(key)).To(Equal(2))
+
+		tenant = "other"
+		_, code, _, _ = h.ContentExists(probe())
+		Expect(code).To(Equal(404))
+		_, code, _, _ = h.CompleteByHash(probe())
+		Expect(code).To(Equal(404))
+
+		h.Identity = func(r *http.Request) (string, error) { return "", errors.New("no session") }
+		_, code, _, _ = h.ContentExists(probe())
+		Expect(code).To(Equal(401))
+	})
+})
@@ -0,0 +1,200 @@
+package images
+
+import (
+	"context"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/fw/me"
+)
+
+// MetadataKey - the UploadOutcome.Metadata entry holding the *Info of an image
+const MetadataKey = "image"
+
+const (
+	defaultQuality   = 85
+	defaultMaxPixels = 50 << 20
+)
+
+// Formats - the media types Processor decodes, use them as Stage.ContentTypes
+var Formats = []string{"image/jpeg", "image/png", "image/gif"}
+
+// Variant - a derived copy of an image, scaled down to fit MaxWidth and MaxHeight. Images are never scaled
+// up, a variant without limits is a full size copy. Every variant is re-encoded, which drops EXIF and other
+// metadata; the EXIF orientation is applied first so photos stay upright.
+type Variant struct {
+	// Name - added to the filename, "photo.jpg" gets "photo_thumb.jpg" for "thumb"
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+	// Format - "jpeg", "png" or "gif", defaults to the format of the original
+	Format string
+	// Quality - of jpeg variants, defaults to 85
+	Quality int
+}
+
+// Info - dimensions of an image and of the variants made from it
+type Info struct {
+	Format   string   `json:"format"`
+	Width    int      `json:"width"`
+	Height   int      `json:"height"`
+	Variants []Output `json:"variants,omitempty"`
+}
+
+// Output - a variant as written
+type Output struct {
+	Variant string `json:"variant"`
+	Name    string `json:"name"`
+	Uri     string `json:"uri"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+}
+
+// Processor - a chunk.Processor writing Variants of every JPEG, PNG and GIF file next to it, or to the
+// pipeline's Derivatives. Other files are skipped. Only the first frame of an animated GIF is used.
+type Processor struct {
+	Variants []Variant
+	// MaxPixels - larger images fail instead of being decoded, defaults to 50 megapixels
+	MaxPixels int64
+}
+
+func (p *Processor) Process(ctx context.Context, f *chunk.ProcessedFile) error {
+	if !chunk.MatchMediaType(Formats, f.Info.MediaType()) {
+		return nil
+	}
+
+	decoded, format, orientation, err := p.decode(ctx, f)
+	if err != nil {
+		return err
+	}
+	img, err := orient(ctx, toRGBA(decoded), orientation)
+	if err != nil {
+		return err
+	}
+
+	info := &Info{Format: format, Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}
+	for _, v := range p.Variants {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		out, err := p.write(ctx, f, img, format, v)
+		if err != nil {
+			return err
+		}
+		info.Variants = append(info.Variants, *out)
+	}
+	f.SetMetadata(MetadataKey, info)
+	return nil
+}
+
+// decode - the image, its format and EXIF orientation, refusing images of more than MaxPixels. Reads fail
+// once ctx is done.
+func (p *Processor) decode(ctx context.Context, f *chunk.ProcessedFile) (image.Image, string, int, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	config, _, err := image.DecodeConfig(r)
+	r.Close()
+	if err != nil {
+		return nil, "", 0, me.Err(err, "failed to read image header", &me.KV{"filename", f.Filename})
+	}
+
+	max := p.MaxPixels
+	if max <= 0 {
+		max = defaultMaxPixels
+	}
+	if int64(config.Width)*int64(config.Height) > max {
+		return nil, "", 0, me.NewErr("image too large to decode", &me.KV{"width", config.Width}, &me.KV{"height", config.Height})
+	}
+
+	if r, err = f.Open(); err != nil {
+		return nil, "", 0, err
+	}
+	defer r.Close()
+	exif := &exifReader{r: r}
+	img, format, err := image.Decode(exif)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, "", 0, me.Err(err, "failed to decode image", &me.KV{"filename", f.Filename})
+	}
+	return img, format, exif.orientation(), nil
+}
+
+// write - the variant v of img
+func (p *Processor) write(ctx context.Context, f *chunk.ProcessedFile, img *image.RGBA, format string, v Variant) (*Output, error) {
+	if v.Format != "" {
+		format = v.Format
+	}
+	width, height := fit(img.Bounds().Dx(), img.Bounds().Dy(), v.MaxWidth, v.MaxHeight)
+	scaled, err := resize(ctx, img, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := f.AvoidCollision(strings.TrimSuffix(f.Filename, path.Ext(f.Filename))+"_"+v.Name+extension(format), nil)
+	if err != nil {
+		return nil, err
+	}
+	w, err := f.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "jpeg":
+		quality := v.Quality
+		if quality <= 0 {
+			quality = defaultQuality
+		}
+		err = jpeg.Encode(w, scaled, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(w, scaled)
+	case "gif":
+		err = gif.Encode(w, scaled, nil)
+	default:
+		err = me.NewErr("unknown image format", &me.KV{"format", format})
+	}
+	if err != nil {
+		chunk.Discard(w) //the pipeline deletes it with the file
+		return nil, me.Err(err, "failed to encode image variant", &me.KV{"name", name})
+	}
+	if err = w.Close(); err != nil {
+		return nil, me.Err(err, "failed to write image variant", &me.KV{"name", name})
+	}
+	return &Output{Variant: v.Name, Name: name, Uri: f.DerivedUri(name), Width: width, Height: height}, nil
+}
+
+func extension(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// fit - the largest size of the same aspect ratio within maxWidth and maxHeight, never larger than the image
+func fit(width, height, maxWidth, maxHeight int) (int, int) {
+	w, h := width, height
+	if maxWidth > 0 && w > maxWidth {
+		h = h * maxWidth / w
+		w = maxWidth
+	}
+	if maxHeight > 0 && h > maxHeight {
+		w = w * maxHeight / h
+		h = maxHeight
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
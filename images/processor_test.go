@@ -0,0 +1,158 @@
+package images_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/images"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// withOrientation - a JPEG with an EXIF segment holding only the orientation tag
+func withOrientation(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	var b bytes.Buffer
+	b.Write(jpg[:2])
+	b.Write([]byte{0xff, 0xe1})
+	binary.Write(&b, binary.BigEndian, uint16(len(segment)+2))
+	b.Write(segment)
+	b.Write(jpg[2:])
+	return b.Bytes()
+}
+
+var _ = Describe("Processor", func() {
+	var folder string
+	var chunks, complete *chunk.FileDestination
+	var collision chunk.CollisionPolicy
+
+	BeforeEach(func() {
+		collision = chunk.CollisionOverwrite
+		folder, _ = ioutil.TempDir("", "images")
+		chunks = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	picture := func(w, h int) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 200, 255})
+			}
+		}
+		return img
+	}
+
+	processor := &Processor{Variants: []Variant{
+		{Name: "thumb", MaxWidth: 10, MaxHeight: 10},
+		{Name: "clean"},
+		{Name: "preview", MaxWidth: 20, Format: "jpeg"},
+	}}
+
+	assemble := func(filename string, content []byte) *chunk.UploadOutcome {
+		u := &chunk.ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: len(content), ChunkSize: len(content), TotalSize: int64(len(content)),
+			TotalChunks: 1, Identifier: filename, Filename: filename, Destination: chunks}
+		source, err := u.UploadChunk(bytes.NewReader(content))
+		Expect(err).NotTo(HaveOccurred())
+
+		pipeline := &chunk.Pipeline{Stages: []*chunk.Stage{{Name: "images", Processor: processor, ContentTypes: Formats}}}
+		fa := &chunk.FileAssembler{Pipeline: pipeline}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *chunk.UploadOutcome, 1)
+		fa.Post(&chunk.AssembleFolder{Source: source, Destination: complete, Naming: chunk.Naming{Policy: chunk.NameByOriginal, Collision: collision},
+			Callback: func(o *chunk.UploadOutcome) { outcomes <- o }})
+
+		var outcome *chunk.UploadOutcome
+		Eventually(outcomes, 5*time.Second).Should(Receive(&outcome))
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		return outcome
+	}
+
+	decode := func(name string) (image.Image, []byte) {
+		b, err := ioutil.ReadFile(filepath.Join(complete.FolderRoot, name))
+		Expect(err).NotTo(HaveOccurred())
+		img, _, err := image.Decode(bytes.NewReader(b))
+		Expect(err).NotTo(HaveOccurred())
+		return img, b
+	}
+
+	It("should write resized variants and report their dimensions", func() {
+		var b bytes.Buffer
+		Expect(png.Encode(&b, picture(40, 20))).To(Succeed())
+		outcome := assemble("photo.png", b.Bytes())
+
+		info := outcome.Metadata[MetadataKey].(*Info)
+		Expect(info.Format).To(Equal("png"))
+		Expect([]int{info.Width, info.Height}).To(Equal([]int{40, 20}))
+		Expect(info.Variants).To(HaveLen(3))
+		Expect(outcome.Derived).To(HaveLen(3))
+
+		thumb := info.Variants[0]
+		Expect(thumb.Name).To(Equal("photo_thumb.png"))
+		Expect(thumb.Uri).To(Equal(outcome.Derived[0].Uri))
+		Expect([]int{thumb.Width, thumb.Height}).To(Equal([]int{10, 5}))
+		img, _ := decode(thumb.Name)
+		Expect(img.Bounds().Dx()).To(Equal(10))
+
+		Expect(info.Variants[1].Width).To(Equal(40)) //never scaled up
+		Expect(info.Variants[2].Name).To(Equal("photo_preview.jpg"))
+	})
+
+	It("should not replace a variant name that is taken", func() {
+		collision = chunk.CollisionSuffix
+		Expect(os.MkdirAll(complete.FolderRoot, 0774)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(complete.FolderRoot, "photo_thumb.png"), []byte("kept"), 0664)).To(Succeed())
+
+		var b bytes.Buffer
+		Expect(png.Encode(&b, picture(40, 20))).To(Succeed())
+		outcome := assemble("photo.png", b.Bytes())
+
+		info := outcome.Metadata[MetadataKey].(*Info)
+		Expect(info.Variants[0].Name).To(Equal("photo_thumb-1.png"))
+		kept, _ := ioutil.ReadFile(filepath.Join(complete.FolderRoot, "photo_thumb.png"))
+		Expect(string(kept)).To(Equal("kept"))
+	})
+
+	It("should strip metadata and keep photos upright", func() {
+		var b bytes.Buffer
+		Expect(jpeg.Encode(&b, picture(40, 20), nil)).To(Succeed())
+		outcome := assemble("photo.jpg", withOrientation(b.Bytes(), 6))
+
+		info := outcome.Metadata[MetadataKey].(*Info)
+		Expect([]int{info.Width, info.Height}).To(Equal([]int{20, 40}))
+
+		img, content := decode("photo_clean.jpg")
+		Expect([]int{img.Bounds().Dx(), img.Bounds().Dy()}).To(Equal([]int{20, 40}))
+		Expect(bytes.Contains(content, []byte("Exif"))).To(BeFalse())
+
+		//turned clockwise, the top left corner is now the top right one
+		r, g, _, _ := img.At(19, 0).RGBA()
+		Expect(r >> 8).To(BeNumerically("<", 16))
+		Expect(g >> 8).To(BeNumerically("<", 16))
+		_, g, _, _ = img.At(0, 0).RGBA()
+		Expect(g >> 8).To(BeNumerically("~", 76, 16))
+	})
+
+	It("should leave other files alone", func() {
+		outcome := assemble("notes.txt", []byte("not an image"))
+		Expect(outcome.Metadata).To(BeEmpty())
+		Expect(outcome.Derived).To(BeEmpty())
+	})
+})
@@ -0,0 +1,180 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// maxExifScan - bytes at the start of a file searched for the EXIF segment, which is at most 64KB
+const maxExifScan = 128 << 10
+
+// exifReader - passes reads through, keeping the start of the file to find the EXIF orientation in
+type exifReader struct {
+	r    io.Reader
+	head bytes.Buffer
+}
+
+func (e *exifReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if room := maxExifScan - e.head.Len(); room > 0 {
+		if n < room {
+			room = n
+		}
+		e.head.Write(p[:room])
+	}
+	return n, err
+}
+
+// orientation - the EXIF orientation of a JPEG, 1 when there is none
+func (e *exifReader) orientation() int {
+	b := e.head.Bytes()
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker, size := b[i+1], int(binary.BigEndian.Uint16(b[i+2:]))
+		if marker == 0xda || marker == 0xd9 || size < 2 || i+2+size > len(b) {
+			break
+		}
+		segment := b[i+4 : i+2+size]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// tiffOrientation - tag 0x0112 of the first IFD
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(t[4:]))
+	if ifd < 8 || ifd+2 > len(t) {
+		return 1
+	}
+	count := int(order.Uint16(t[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(t) {
+			break
+		}
+		if order.Uint16(t[entry:]) == 0x0112 {
+			if o := int(order.Uint16(t[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// toRGBA - img as an RGBA image with its origin at 0,0, converted once for orient and every resize
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	if rgba, ok := img.(*image.RGBA); ok && b.Min == (image.Point{}) {
+		return rgba
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
+
+// orient - src turned upright for an EXIF orientation, copying pixels between the buffers. Stops with the
+// error of ctx once it is done.
+func orient(ctx context.Context, src *image.RGBA, orientation int) (*image.RGBA, error) {
+	if orientation <= 1 || orientation > 8 {
+		return src, nil
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		row := src.Pix[y*src.Stride : y*src.Stride+w*4]
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			i := dy*dst.Stride + dx*4
+			copy(dst.Pix[i:i+4], row[x*4:x*4+4])
+		}
+	}
+	return dst, nil
+}
+
+// resize - src scaled to width by height by averaging the source pixels each target pixel covers. Stops
+// with the error of ctx once it is done.
+func resize(ctx context.Context, src *image.RGBA, width, height int) (*image.RGBA, error) {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw == width && sh == height {
+		return src, nil
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for dy := 0; dy < height; dy++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		y0, y1 := span(dy, height, sh)
+		for dx := 0; dx < width; dx++ {
+			x0, x1 := span(dx, width, sw)
+			var r, g, bl, a, n uint64
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4 : x*4+4]
+					r, g, bl, a = r+uint64(p[0]), g+uint64(p[1]), bl+uint64(p[2]), a+uint64(p[3])
+					n++
+				}
+			}
+			dst.SetRGBA(dx, dy, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), uint8(a / n)})
+		}
+	}
+	return dst, nil
+}
+
+// span - the source rows or columns target i of n covers in a source of size pixels, at least one
+func span(i, n, size int) (int, int) {
+	from, to := i*size/n, (i+1)*size/n
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
@@ -0,0 +1,45 @@
+package chunk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gotgo/fw/me"
+)
+
+// jsonFile - a value kept as JSON at path, what names it in errors
+type jsonFile struct {
+	path string
+	what string
+}
+
+// load - decode the file into v, a missing file leaves v as is
+func (j jsonFile) load(v interface{}) error {
+	b, err := ioutil.ReadFile(j.path)
+	if err != nil && !os.IsNotExist(err) {
+		return me.Err(err, "failed to read "+j.what, &me.KV{"path", j.path})
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, v); err != nil {
+			return me.Err(err, "failed to parse "+j.what, &me.KV{"path", j.path})
+		}
+	}
+	return nil
+}
+
+// save - replace the file with v through WriteFileAtomic, the file and its folder are flushed
+func (j jsonFile) save(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(j.path), 0774); err != nil {
+		return me.Err(err, "failed to create "+j.what+" folder", &me.KV{"path", j.path})
+	}
+	if err = WriteFileAtomic(j.path, b); err != nil {
+		return me.Err(err, "failed to write "+j.what, &me.KV{"path", j.path})
+	}
+	return nil
+}
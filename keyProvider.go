@@ -0,0 +1,94 @@
+package chunk
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gotgo/fw/me"
+)
+
+// keySize - AES-256
+const keySize = 32
+
+// KeyProvider - the keys of an encrypting destination
+type KeyProvider interface {
+	// CurrentKey - id and key to encrypt new files with
+	CurrentKey() (string, []byte, error)
+	// Key - the key with id, to decrypt files written with it
+	Key(id string) ([]byte, error)
+}
+
+// KeyFile - keys kept in a local file, one "<id> <64 hex characters>" per line. The last line is the
+// current key, so keys are rotated by appending a line and keeping the old ones for decryption.
+// Lines starting with # are ignored. The file is read once.
+type KeyFile struct {
+	Path string
+
+	once    sync.Once
+	err     error
+	keys    map[string][]byte
+	current string
+}
+
+func (k *KeyFile) CurrentKey() (string, []byte, error) {
+	if err := k.load(); err != nil {
+		return "", nil, err
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *KeyFile) Key(id string) ([]byte, error) {
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, me.NewErr("unknown encryption key", &me.KV{"id", id}, &me.KV{"path", k.Path})
+	}
+	return key, nil
+}
+
+func (k *KeyFile) load() error {
+	k.once.Do(func() {
+		k.err = k.read()
+	})
+	return k.err
+}
+
+func (k *KeyFile) read() error {
+	file, err := os.Open(k.Path)
+	if err != nil {
+		return me.Err(err, "failed to open key file", &me.KV{"path", k.Path})
+	}
+	defer file.Close()
+
+	k.keys = make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 || len(fields[0]) > maxKeyIdSize {
+			return me.NewErr("malformed key file line", &me.KV{"path", k.Path}, &me.KV{"line", line})
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return me.NewErr("key is not 64 hex characters", &me.KV{"path", k.Path}, &me.KV{"line", line})
+		}
+		k.keys[fields[0]] = key
+		k.current = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return me.Err(err, "failed to read key file", &me.KV{"path", k.Path})
+	}
+	if k.current == "" {
+		return me.NewErr("key file holds no keys", &me.KV{"path", k.Path})
+	}
+	return nil
+}
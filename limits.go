@@ -0,0 +1,144 @@
+package chunk
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Names of the limits in a LimitError
+const (
+	LimitFileSize    = "file size"
+	LimitChunks      = "chunks"
+	LimitChunkSize   = "chunk size"
+	LimitSessions    = "concurrent sessions"
+	LimitStoredBytes = "stored bytes"
+)
+
+const defaultSessionTimeout = 24 * time.Hour
+
+// LimitError - an upload refused by Limits
+type LimitError struct {
+	Limit string
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return e.Limit + " limit exceeded: " + strconv.FormatInt(e.Value, 10) + " > " + strconv.FormatInt(e.Max, 10)
+}
+
+// IsLimitError - true if err is a *LimitError
+func IsLimitError(err error) bool {
+	_, ok := err.(*LimitError)
+	return ok
+}
+
+// Limits - caps on uploads, zero means no limit. Sizes are checked on every chunk, the per tenant
+// quotas when a session starts. The sessions of a tenant count against MaxStoredBytes with their
+// TotalSize until they are assembled, so add Limits to FileAssembler.Observer to settle them.
+type Limits struct {
+	MaxFileSize  int64
+	MaxChunks    int
+	MaxChunkSize int
+	// MaxSessions - incomplete sessions a tenant may have open at once
+	MaxSessions int
+	// MaxStoredBytes - bytes a tenant may have stored and reserved by open sessions
+	MaxStoredBytes int64
+	// SessionTimeout - open sessions older than this stop counting, defaults to a day
+	SessionTimeout time.Duration
+	// Accounting - the usage of every tenant, defaults to a MemoryAccounting
+	Accounting Accounting
+
+	NopObserver
+	once sync.Once
+}
+
+func (l *Limits) accounting() Accounting {
+	l.once.Do(func() {
+		if l.Accounting == nil {
+			l.Accounting = &MemoryAccounting{}
+		}
+	})
+	return l.Accounting
+}
+
+// check - the size limits, for every chunk
+func (l *Limits) check(u *ChunkUpload) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxFileSize > 0 && u.TotalSize > l.MaxFileSize {
+		return &LimitError{Limit: LimitFileSize, Value: u.TotalSize, Max: l.MaxFileSize}
+	}
+	if l.MaxChunks > 0 && u.TotalChunks > l.MaxChunks {
+		return &LimitError{Limit: LimitChunks, Value: int64(u.TotalChunks), Max: int64(l.MaxChunks)}
+	}
+	if l.MaxChunkSize > 0 && u.CurrentChunkSize > l.MaxChunkSize {
+		return &LimitError{Limit: LimitChunkSize, Value: int64(u.CurrentChunkSize), Max: int64(l.MaxChunkSize)}
+	}
+	return nil
+}
+
+// open - reserve a session of the tenant, when its first chunk arrives
+func (l *Limits) open(u *ChunkUpload) error {
+	if l == nil {
+		return nil
+	}
+	key := u.chunkFolderName()
+	return l.accounting().Update(u.Tenant, func(usage *Usage) error {
+		l.expire(usage)
+		if _, ok := usage.Sessions[key]; ok {
+			return nil
+		}
+		if l.MaxSessions > 0 && len(usage.Sessions) >= l.MaxSessions {
+			return &LimitError{Limit: LimitSessions, Value: int64(len(usage.Sessions) + 1), Max: int64(l.MaxSessions)}
+		}
+		if total := usage.reserved() + usage.StoredBytes + u.TotalSize; l.MaxStoredBytes > 0 && total > l.MaxStoredBytes {
+			return &LimitError{Limit: LimitStoredBytes, Value: total, Max: l.MaxStoredBytes}
+		}
+		usage.Sessions[key] = SessionUsage{Size: u.TotalSize, Started: time.Now().UTC()}
+		return nil
+	})
+}
+
+// close - drop the reservation of a session, adding stored bytes when it was assembled
+func (l *Limits) close(tenant, key string, stored int64) error {
+	if l == nil {
+		return nil
+	}
+	return l.accounting().Update(tenant, func(usage *Usage) error {
+		delete(usage.Sessions, key)
+		usage.StoredBytes += stored
+		if usage.StoredBytes < 0 {
+			usage.StoredBytes = 0
+		}
+		return nil
+	})
+}
+
+// Release - give back bytes a tenant no longer stores, after deleting an assembled file
+func (l *Limits) Release(tenant string, bytes int64) error {
+	return l.close(tenant, "", -bytes)
+}
+
+// AssemblyFinished - settle the session, its file counts as stored when assembled and nothing was deduplicated
+func (l *Limits) AssemblyFinished(a *AssembleFolder, outcome *UploadOutcome) {
+	var stored int64
+	if outcome.Err == nil && !outcome.Deduplicated {
+		stored = outcome.Size
+	}
+	l.close(a.Source.Tenant, a.Source.key(), stored)
+}
+
+func (l *Limits) expire(usage *Usage) {
+	timeout := l.SessionTimeout
+	if timeout <= 0 {
+		timeout = defaultSessionTimeout
+	}
+	for key, s := range usage.Sessions {
+		if time.Since(s.Started) > timeout {
+			delete(usage.Sessions, key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package chunk_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits", func() {
+	var folder string
+	var d *FileDestination
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "limits")
+		d = &FileDestination{FolderRoot: folder}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	upload := func(limits *Limits, identifier string, totalSize int64) error {
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 5, ChunkSize: 5, TotalSize: totalSize, TotalChunks: int(totalSize / 5), Identifier: identifier, Tenant: "acme", Destination: d, Limits: limits}
+		_, err := u.UploadChunk(strings.NewReader("12345"))
+		return err
+	}
+
+	limitOf := func(err error) string {
+		if le, ok := err.(*LimitError); ok {
+			return le.Limit
+		}
+		return ""
+	}
+
+	It("should cap sizes and concurrent sessions", func() {
+		limits := &Limits{MaxFileSize: 100, MaxSessions: 2}
+		Expect(limitOf(upload(limits, "huge", 500))).To(Equal(LimitFileSize))
+		Expect(upload(limits, "a", 50)).To(BeNil())
+		Expect(upload(limits, "b", 50)).To(BeNil())
+		Expect(upload(limits, "a", 50)).To(BeNil()) //a chunk of an open session
+		Expect(limitOf(upload(limits, "c", 50))).To(Equal(LimitSessions))
+
+		Expect((&ChunkUpload{Identifier: "b", Tenant: "acme", Destination: d, Limits: limits}).Abort()).To(BeNil())
+		Expect(upload(limits, "c", 50)).To(BeNil())
+	})
+
+	It("should count stored bytes across restarts", func() {
+		path := filepath.Join(folder, "accounting.json")
+		limits := &Limits{MaxStoredBytes: 100, Accounting: &FileAccounting{Path: path}}
+		Expect(upload(limits, "a", 60)).To(BeNil())
+
+		source := &ChunkFolder{Identifier: "a", Tenant: "acme"}
+		limits.AssemblyFinished(&AssembleFolder{Source: source}, &UploadOutcome{Size: 60})
+
+		restarted := &Limits{MaxStoredBytes: 100, Accounting: &FileAccounting{Path: path}}
+		Expect(limitOf(upload(restarted, "b", 60))).To(Equal(LimitStoredBytes))
+		Expect(restarted.Release("acme", 60)).To(BeNil())
+		Expect(upload(restarted, "b", 60)).To(BeNil())
+	})
+})
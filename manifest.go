@@ -0,0 +1,154 @@
+package chunk
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/gotgo/fw/me"
+)
+
+// manifestFilename - stored next to the chunks, its presence marks a started session
+const manifestFilename = "manifest.json"
+
+// SessionManifest - metadata of an upload session, written when its first chunk arrives
+type SessionManifest struct {
+	Identifier   string
+	Tenant       string `json:",omitempty"`
+	Filename     string
+	RelativePath string
+	ChunkSize    int
+	TotalSize    int64
+	TotalChunks  int
+	//ContentType - detected from the first chunk, empty until it arrived
+	ContentType string `json:",omitempty"`
+	//Rejected - why the first chunk was refused, later chunks of the session are refused with it too
+	Rejected *FileTypeError `json:",omitempty"`
+	Started  time.Time
+}
+
+func (u *ChunkUpload) manifest(contentType string) *SessionManifest {
+	return &SessionManifest{
+		Identifier:   u.Identifier,
+		Tenant:       u.Tenant,
+		Filename:     u.Filename,
+		RelativePath: u.RelativePath,
+		ChunkSize:    u.ChunkSize,
+		TotalSize:    u.TotalSize,
+		TotalChunks:  u.TotalChunks,
+		ContentType:  contentType,
+		Started:      time.Now().UTC(),
+	}
+}
+
+// startSession - writes the manifest if the session has none yet, returns true if this chunk started the session.
+// A destination that is an Admitter and the tenant quotas of Limits can refuse the session first. contentType
+// is set by the first chunk, it is added to the manifest of a session a later chunk started. Destinations that
+// are an ExclusiveCreator let exactly one of the chunks arriving together start the session.
+func (u *ChunkUpload) startSession(d FolderDestination, contentType string) (bool, error) {
+	if d.Size(manifestFilename) >= 0 {
+		return false, u.joinSession(d, contentType)
+	}
+
+	if a, ok := d.(Admitter); ok {
+		if err := a.Admit(u.TotalSize); err != nil {
+			return false, err
+		}
+	}
+	if err := u.Limits.open(u); err != nil {
+		return false, err
+	}
+
+	w, err := createExclusive(d, manifestFilename)
+	if err != nil {
+		u.Limits.close(u.Tenant, u.chunkFolderName(), 0)
+		return false, me.Err(err, "failed to create session manifest", &me.KV{"identifier", u.Identifier})
+	}
+	err = encodeManifest(d, w, u.manifest(contentType))
+	if err == ErrFileExists {
+		//another chunk started it, its reservation is the one of the session
+		return false, u.joinSession(d, contentType)
+	}
+	if err != nil {
+		u.Limits.close(u.Tenant, u.chunkFolderName(), 0)
+		return false, err
+	}
+	return true, nil
+}
+
+// joinSession - a chunk of a started session, adding contentType to its manifest. Returns the rejection of
+// a session whose first chunk was refused. Both are skipped when d cannot read the manifest back.
+func (u *ChunkUpload) joinSession(d FolderDestination, contentType string) error {
+	m, err := readManifest(d)
+	if err != nil || m == nil {
+		return err
+	}
+	if m.Rejected != nil {
+		return m.Rejected
+	}
+	if contentType == "" || m.ContentType == contentType {
+		return nil
+	}
+	m.ContentType = contentType
+	return writeManifest(d, m)
+}
+
+// rejectSession - drop the chunks of a session whose first chunk was refused and keep a manifest saying
+// why, so the chunks still on their way are refused too instead of starting it again
+func (u *ChunkUpload) rejectSession(d FolderDestination, rejected *FileTypeError) error {
+	if err := u.Abort(); err != nil {
+		return err
+	}
+	m := u.manifest("")
+	m.Rejected = rejected
+	return writeManifest(d, m)
+}
+
+// readManifest - the session manifest, nil if there is none or d cannot read it back
+func readManifest(d FolderDestination) (*SessionManifest, error) {
+	opener, ok := d.(FileOpener)
+	if !ok || d.Size(manifestFilename) < 0 {
+		return nil, nil
+	}
+
+	r, err := opener.Open(manifestFilename)
+	if err != nil {
+		return nil, me.Err(err, "failed to open session manifest")
+	}
+	defer r.Close()
+
+	m := new(SessionManifest)
+	if err = json.NewDecoder(r).Decode(m); err != nil {
+		return nil, me.Err(err, "failed to read session manifest")
+	}
+	return m, nil
+}
+
+func writeManifest(d FolderDestination, m *SessionManifest) error {
+	w, err := d.Create(manifestFilename)
+	if err != nil {
+		return me.Err(err, "failed to create session manifest", &me.KV{"identifier", m.Identifier})
+	}
+	return encodeManifest(d, w, m)
+}
+
+// encodeManifest - write m to w, dropping what was written on failure. ErrFileExists is returned as it is.
+func encodeManifest(d FolderDestination, w io.WriteCloser, m *SessionManifest) error {
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		if !Discard(w) {
+			_ = d.Delete(manifestFilename)
+		}
+		return me.Err(err, "failed to write session manifest", &me.KV{"identifier", m.Identifier})
+	}
+
+	if err := w.Close(); err != nil {
+		if err == ErrFileExists {
+			return err
+		}
+		if LeftBehind(w) {
+			_ = d.Delete(manifestFilename)
+		}
+		return me.Err(err, "failed to close session manifest", &me.KV{"identifier", m.Identifier})
+	}
+	return nil
+}
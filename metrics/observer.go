@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gotgo/chunk"
+)
+
+const (
+	outcomeOK        = "ok"
+	outcomeError     = "error"
+	outcomeCancelled = "cancelled"
+)
+
+// Observer - a chunk.Observer that records upload and assembly metrics in a Registry. Set it on
+// ChunkUpload, flow.Handler and FileAssembler; every series is labeled by the destination type.
+type Observer struct {
+	registry *Registry
+
+	sessionsStarted   *CounterVec
+	sessionsCompleted *CounterVec
+	chunksReceived    *CounterVec
+	bytesReceived     *CounterVec
+	chunksRejected    *CounterVec
+	chunkDuration     *HistogramVec
+	assemblies        *CounterVec
+	assemblyDuration  *HistogramVec
+	assembling        *GaugeVec
+	cleanupFailures   *CounterVec
+
+	mu         sync.Mutex
+	started    map[*chunk.AssembleFolder]time.Time
+	assemblers []*chunk.FileAssembler
+}
+
+func NewObserver(r *Registry) *Observer {
+	return &Observer{
+		registry:          r,
+		sessionsStarted:   r.Counter("chunk_sessions_started_total", "Upload sessions whose first chunk arrived.", "destination"),
+		sessionsCompleted: r.Counter("chunk_sessions_completed_total", "Upload sessions with all chunks received.", "destination"),
+		chunksReceived:    r.Counter("chunk_chunks_received_total", "Chunks stored.", "destination"),
+		bytesReceived:     r.Counter("chunk_received_bytes_total", "Bytes of chunks stored.", "destination"),
+		chunksRejected:    r.Counter("chunk_chunks_rejected_total", "Chunks refused by the flow handler or ChunkUpload.", "destination"),
+		chunkDuration:     r.Histogram("chunk_chunk_duration_seconds", "Time spent storing a chunk.", nil, "destination"),
+		assemblies:        r.Counter("chunk_assemblies_total", "Finished assemblies.", "destination", "outcome"),
+		assemblyDuration:  r.Histogram("chunk_assembly_duration_seconds", "Time spent assembling a file.", nil, "destination", "outcome"),
+		assembling:        r.Gauge("chunk_assemblies_in_progress", "Assemblies currently running.", "destination"),
+		cleanupFailures:   r.Counter("chunk_cleanup_failures_total", "Chunk folders or partial files that could not be removed."),
+		started:           make(map[*chunk.AssembleFolder]time.Time),
+	}
+}
+
+// WatchAssembler - add the queue depth of fa to chunk_assembler_queue_depth, the sum over every watched
+// assembler
+func (o *Observer) WatchAssembler(fa *chunk.FileAssembler) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.assemblers = append(o.assemblers, fa)
+	if len(o.assemblers) > 1 {
+		return
+	}
+	o.registry.GaugeFunc("chunk_assembler_queue_depth", "Folders posted to the assemblers and not yet picked up.", o.queueDepth)
+}
+
+func (o *Observer) queueDepth() float64 {
+	o.mu.Lock()
+	assemblers := append([]*chunk.FileAssembler(nil), o.assemblers...)
+	o.mu.Unlock()
+
+	var depth int
+	for _, fa := range assemblers {
+		depth += fa.QueueDepth()
+	}
+	return float64(depth)
+}
+
+func (o *Observer) SessionStarted(u *chunk.ChunkUpload) {
+	o.sessionsStarted.With(uploadDestination(u)).Inc()
+}
+
+func (o *Observer) ChunkReceived(u *chunk.ChunkUpload, size int64, elapsed time.Duration) {
+	d := uploadDestination(u)
+	o.chunksReceived.With(d).Inc()
+	o.bytesReceived.With(d).Add(float64(size))
+	o.chunkDuration.With(d).Observe(elapsed.Seconds())
+}
+
+func (o *Observer) ChunkRejected(u *chunk.ChunkUpload, reason error) {
+	o.chunksRejected.With(uploadDestination(u)).Inc()
+}
+
+func (o *Observer) SessionComplete(u *chunk.ChunkUpload, folder *chunk.ChunkFolder) {
+	o.sessionsCompleted.With(uploadDestination(u)).Inc()
+}
+
+func (o *Observer) AssemblyStarted(a *chunk.AssembleFolder) {
+	o.mu.Lock()
+	o.started[a] = time.Now()
+	o.mu.Unlock()
+	o.assembling.With(destinationType(a.Destination)).Inc()
+}
+
+func (o *Observer) AssemblyFinished(a *chunk.AssembleFolder, outcome *chunk.UploadOutcome) {
+	o.mu.Lock()
+	started, ok := o.started[a]
+	delete(o.started, a)
+	o.mu.Unlock()
+
+	d := destinationType(a.Destination)
+	result := outcomeOK
+	if outcome.Err == chunk.ErrAssemblyCancelled {
+		result = outcomeCancelled
+	} else if outcome.Err != nil {
+		result = outcomeError
+	}
+
+	o.assembling.With(d).Dec()
+	o.assemblies.With(d, result).Inc()
+	if ok {
+		o.assemblyDuration.With(d, result).Observe(time.Since(started).Seconds())
+	}
+}
+
+func (o *Observer) CleanupFailed(identifier string, err error) {
+	o.cleanupFailures.With().Inc()
+}
+
+func uploadDestination(u *chunk.ChunkUpload) string {
+	if u == nil {
+		return destinationType(nil)
+	}
+	return destinationType(u.Destination)
+}
+
+// destinationType - the type name of a destination, FileDestination, S3Destination..
+func destinationType(d interface{}) string {
+	if d == nil {
+		return "unknown"
+	}
+	t := reflect.TypeOf(d)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
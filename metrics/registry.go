@@ -0,0 +1,420 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets - histogram upper bounds in seconds, from 5ms to 5 minutes
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// collector - a metric family that can write itself in the prometheus text format
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry - holds metrics and serves them in the prometheus text exposition format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Counter - a monotonically increasing value, partitioned by labels
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: newFamily(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Gauge - a value that goes up and down, partitioned by labels
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family: newFamily(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// GaugeFunc - a gauge read from fn at every scrape
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&gaugeFunc{family: newFamily(name, help, "gauge", nil), fn: fn})
+}
+
+// Histogram - observations counted into buckets, partitioned by labels. Nil buckets uses DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &HistogramVec{family: newFamily(name, help, "histogram", labels), buckets: b}
+	r.register(h)
+	return h
+}
+
+// WriteTo - write all metrics in the prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, c := range collectors {
+		if err := c.write(cw); err != nil {
+			return cw.n, err
+		}
+	}
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+////////////////////////////
+
+// family - name, help and label names shared by all series of a metric
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func newFamily(name, help, kind string, labels []string) family {
+	return family{name: name, help: help, kind: kind, labels: labels}
+}
+
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (f *family) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+	return err
+}
+
+// labelString - {a="1",b="2"}, extra is appended as is, for the histogram le label
+func (f *family) labelString(values []string, extra string) string {
+	if len(values) == 0 && extra == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, f.labels[i]+`="`+escapeLabel(v)+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+////////////////////////////
+
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]*Counter
+}
+
+type Counter struct {
+	values []string
+	mu     sync.Mutex
+	value  float64
+}
+
+// With - the counter for the label values, in the order the labels were declared
+func (c *CounterVec) With(values ...string) *Counter {
+	key := c.key(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.series == nil {
+		c.series = make(map[string]*Counter)
+	}
+	s, ok := c.series[key]
+	if !ok {
+		s = &Counter{values: append([]string(nil), values...)}
+		c.series[key] = s
+	}
+	return s
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add - v must not be negative
+func (c *Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.mu.Lock()
+	c.value += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) get() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.value
+}
+
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.header(w); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	series := make([]*Counter, 0, len(c.series))
+	for _, k := range sortedKeys(c.series) {
+		series = append(series, c.series[k])
+	}
+	c.mu.Unlock()
+	for _, s := range series {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(s.values, ""), formatFloat(s.get())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////
+
+type GaugeVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]*Gauge
+}
+
+type Gauge struct {
+	values []string
+	mu     sync.Mutex
+	value  float64
+}
+
+// With - the gauge for the label values, in the order the labels were declared
+func (g *GaugeVec) With(values ...string) *Gauge {
+	key := g.key(values)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.series == nil {
+		g.series = make(map[string]*Gauge)
+	}
+	s, ok := g.series[key]
+	if !ok {
+		s = &Gauge{values: append([]string(nil), values...)}
+		g.series[key] = s
+	}
+	return s
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(v float64) {
+	g.mu.Lock()
+	g.value += v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *GaugeVec) write(w io.Writer) error {
+	if err := g.header(w); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	series := make([]*Gauge, 0, len(g.series))
+	for _, k := range sortedKeys(g.series) {
+		series = append(series, g.series[k])
+	}
+	g.mu.Unlock()
+	for _, s := range series {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(s.values, ""), formatFloat(s.get())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gaugeFunc struct {
+	family
+	fn func() float64
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	if err := g.header(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+	return err
+}
+
+////////////////////////////
+
+type HistogramVec struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*Histogram
+}
+
+type Histogram struct {
+	values  []string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// With - the histogram for the label values, in the order the labels were declared
+func (h *HistogramVec) With(values ...string) *Histogram {
+	key := h.key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*Histogram)
+	}
+	s, ok := h.series[key]
+	if !ok {
+		s = &Histogram{values: append([]string(nil), values...), buckets: h.buckets, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	return s
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.header(w); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	series := make([]*Histogram, 0, len(h.series))
+	for _, k := range sortedKeys(h.series) {
+		series = append(series, h.series[k])
+	}
+	h.mu.Unlock()
+	for _, s := range series {
+		s.mu.Lock()
+		counts, count, sum := append([]uint64(nil), s.counts...), s.count, s.sum
+		s.mu.Unlock()
+
+		for i, upper := range h.buckets {
+			le := `le="` + formatFloat(upper) + `"`
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.values, le), counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.values, `le="+Inf"`), count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.values, ""), formatFloat(sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.values, ""), count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+////////////////////////////
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch series := m.(type) {
+	case map[string]*Counter:
+		for k := range series {
+			keys = append(keys, k)
+		}
+	case map[string]*Gauge:
+		for k := range series {
+			keys = append(keys, k)
+		}
+	case map[string]*Histogram:
+		for k := range series {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
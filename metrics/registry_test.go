@@ -0,0 +1,81 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+
+	It("should write the prometheus text format", func() {
+		r := NewRegistry()
+		c := r.Counter("uploads_total", "Uploads.", "destination")
+		c.With("FileDestination").Add(2)
+		c.With(`S3"Destination`).Inc()
+		h := r.Histogram("latency_seconds", "Latency.", []float64{1, 0.5})
+		h.With().Observe(0.7)
+
+		var out bytes.Buffer
+		_, err := r.WriteTo(&out)
+		Expect(err).To(BeNil())
+		Expect(out.String()).To(Equal(`# HELP uploads_total Uploads.
+# TYPE uploads_total counter
+uploads_total{destination="FileDestination"} 2
+uploads_total{destination="S3\"Destination"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 0
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.7
+latency_seconds_count 1
+`))
+	})
+
+	It("should label assemblies by destination and outcome", func() {
+		r := NewRegistry()
+		o := NewObserver(r)
+		a := &chunk.AssembleFolder{Destination: &chunk.FileDestination{}}
+		o.AssemblyStarted(a)
+		o.AssemblyFinished(a, &chunk.UploadOutcome{Err: errors.New("failed")})
+
+		var out bytes.Buffer
+		r.WriteTo(&out)
+		Expect(out.String()).To(ContainSubstring(`chunk_assemblies_total{destination="FileDestination",outcome="error"} 1`))
+		Expect(out.String()).To(ContainSubstring(`chunk_assemblies_in_progress{destination="FileDestination"} 0`))
+	})
+
+	It("should keep label values the caller reuses", func() {
+		r := NewRegistry()
+		c := r.Counter("uploads_total", "Uploads.", "destination")
+		values := []string{"first"}
+		c.With(values...).Inc()
+		values[0] = "second"
+		c.With(values...).Inc()
+
+		var out bytes.Buffer
+		r.WriteTo(&out)
+		Expect(out.String()).To(ContainSubstring(`uploads_total{destination="first"} 1`))
+		Expect(out.String()).To(ContainSubstring(`uploads_total{destination="second"} 1`))
+	})
+
+	It("should export the queue depth of all watched assemblers once", func() {
+		r := NewRegistry()
+		o := NewObserver(r)
+		o.WatchAssembler(&chunk.FileAssembler{})
+		o.WatchAssembler(&chunk.FileAssembler{})
+
+		var out bytes.Buffer
+		r.WriteTo(&out)
+		Expect(strings.Count(out.String(), "# TYPE chunk_assembler_queue_depth gauge")).To(Equal(1))
+		Expect(out.String()).To(ContainSubstring("chunk_assembler_queue_depth 0\n"))
+	})
+
+})
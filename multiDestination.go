@@ -0,0 +1,207 @@
+package chunk
+
+import (
+	"io"
+
+	"github.com/gotgo/fw/me"
+)
+
+// Replica - one copy of a file written by MultiDestination, Err is set if that copy failed
+type Replica struct {
+	Uri string
+	Err error
+}
+
+// ReplicaReporter - implemented by writers that write more than one copy of a file
+type ReplicaReporter interface {
+	// Replicas - the copies of the file, once the writer is closed
+	Replicas() []Replica
+}
+
+// MultiDestination - a FolderDestination that writes every file to all of Destinations at once. Closing
+// the writer succeeds when at least Quorum replicas commit, the writer then reports every replica. Replicas
+// that fail are discarded and recorded, and when the quorum is missed the replicas that did commit are
+// deleted too.
+type MultiDestination struct {
+	Destinations []FolderDestination
+	// Quorum - replicas that must commit, defaults to all of them
+	Quorum int
+}
+
+func (m *MultiDestination) quorum() int {
+	if m.Quorum <= 0 || m.Quorum > len(m.Destinations) {
+		return len(m.Destinations)
+	}
+	return m.Quorum
+}
+
+func (m *MultiDestination) Create(filename string) (io.WriteCloser, error) {
+	n := len(m.Destinations)
+	t := &teeWriter{
+		m:         m,
+		filename:  filename,
+		writers:   make([]io.WriteCloser, n),
+		errs:      make([]error, n),
+		committed: make([]bool, n),
+		leftover:  make([]bool, n),
+	}
+
+	for i, d := range m.Destinations {
+		w, err := d.Create(filename)
+		if err == nil && w == nil {
+			err = me.NewErr("destination returned no writer")
+		}
+		t.writers[i], t.errs[i] = w, err
+	}
+
+	if t.live() < m.quorum() {
+		t.rollback()
+		return nil, me.Err(t.firstErr(), "failed to create enough replicas", &me.KV{"filename", filename}, &me.KV{"quorum", m.quorum()})
+	}
+	return t, nil
+}
+
+// Delete - delete every replica, returns the first error
+func (m *MultiDestination) Delete(filename string) error {
+	var first error
+	for _, d := range m.Destinations {
+		if err := d.Delete(filename); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Uri - the uri of the first replica found, or of the first destination if there is none
+func (m *MultiDestination) Uri(filename string) string {
+	for _, d := range m.Destinations {
+		if d.Size(filename) >= 0 {
+			return d.Uri(filename)
+		}
+	}
+	if len(m.Destinations) == 0 {
+		return ""
+	}
+	return m.Destinations[0].Uri(filename)
+}
+
+// Size - the size of the first replica found
+func (m *MultiDestination) Size(filename string) int64 {
+	for _, d := range m.Destinations {
+		if size := d.Size(filename); size >= 0 {
+			return size
+		}
+	}
+	return -1
+}
+
+////////////////////////////
+
+// teeWriter - writes to every replica that has not failed yet
+type teeWriter struct {
+	m        *MultiDestination
+	filename string
+	writers  []io.WriteCloser
+	errs     []error
+	// committed - replicas closed successfully
+	committed []bool
+	// leftover - failed replicas whose writer may have left a partial file, which is deleted
+	leftover []bool
+	replicas []Replica
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	for i, w := range t.writers {
+		if t.errs[i] != nil {
+			continue
+		}
+		n, err := w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			t.errs[i] = err
+			t.leftover[i] = !Discard(w)
+		}
+	}
+
+	if t.live() < t.m.quorum() {
+		return 0, me.Err(t.firstErr(), "too many replicas failed", &me.KV{"filename", t.filename}, &me.KV{"quorum", t.m.quorum()})
+	}
+	return len(p), nil
+}
+
+// Close - commit the live replicas, clean up the failed ones and record the outcome of each
+func (t *teeWriter) Close() error {
+	for i, w := range t.writers {
+		if t.errs[i] != nil {
+			continue
+		}
+		if t.errs[i] = w.Close(); t.errs[i] == nil {
+			t.committed[i] = true
+		} else {
+			_, aborter := w.(Aborter)
+			t.leftover[i] = !aborter //an Aborter drops its partial file when Close fails
+		}
+	}
+
+	if t.live() < t.m.quorum() {
+		t.rollback()
+		return me.Err(t.firstErr(), "replicas committed below quorum", &me.KV{"filename", t.filename}, &me.KV{"quorum", t.m.quorum()})
+	}
+
+	t.replicas = make([]Replica, len(t.writers))
+	for i, d := range t.m.Destinations {
+		t.replicas[i] = Replica{Uri: d.Uri(t.filename), Err: t.errs[i]}
+		if t.leftover[i] {
+			d.Delete(t.filename)
+		}
+	}
+	return nil
+}
+
+// Abort - discard every replica that is still open
+func (t *teeWriter) Abort() error {
+	t.rollback()
+	return nil
+}
+
+func (t *teeWriter) Replicas() []Replica {
+	return t.replicas
+}
+
+// rollback - discard the open replicas and delete the committed ones and what failed ones left behind
+func (t *teeWriter) rollback() {
+	for i, d := range t.m.Destinations {
+		if t.writers[i] == nil {
+			continue
+		}
+		if t.errs[i] == nil && !t.committed[i] {
+			t.leftover[i] = !Discard(t.writers[i])
+			t.errs[i] = me.NewErr("rolled back")
+		}
+		if t.committed[i] || t.leftover[i] {
+			d.Delete(t.filename)
+			t.committed[i], t.leftover[i] = false, false
+		}
+	}
+}
+
+func (t *teeWriter) live() int {
+	live := 0
+	for _, err := range t.errs {
+		if err == nil {
+			live++
+		}
+	}
+	return live
+}
+
+func (t *teeWriter) firstErr() error {
+	for _, err := range t.errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package chunk_test
+
+import (
+	"errors"
+	"io"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// FailingDestination - every write fails
+type FailingDestination struct {
+	RecordingDestination
+}
+
+func (d *FailingDestination) Create(filename string) (io.WriteCloser, error) {
+	return d, nil
+}
+
+func (d *FailingDestination) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+var _ = Describe("MultiDestination", func() {
+
+	It("should commit when the quorum is reached", func() {
+		failing := &FailingDestination{}
+		m := &MultiDestination{Destinations: []FolderDestination{&MockDestination{}, failing, &MockDestination{}}, Quorum: 2}
+
+		w, err := m.Create("abcdefg")
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte("data"))
+		Expect(err).To(BeNil())
+		Expect(w.Close()).To(BeNil())
+
+		replicas := w.(ReplicaReporter).Replicas()
+		Expect(replicas).To(HaveLen(3))
+		Expect(replicas[0].Err).To(BeNil())
+		Expect(replicas[1].Err).ToNot(BeNil())
+		Expect(failing.deleted).To(Equal([]string{"abcdefg"}))
+	})
+
+	It("should roll back when the quorum is missed", func() {
+		ok := &RecordingDestination{}
+		m := &MultiDestination{Destinations: []FolderDestination{ok, &FailingDestination{}}}
+
+		w, err := m.Create("abcdefg")
+		Expect(err).To(BeNil())
+		_, err = w.Write([]byte("data"))
+		Expect(err).ToNot(BeNil())
+		Expect(w.Close()).ToNot(BeNil())
+		Expect(ok.deleted).To(ContainElement("abcdefg"))
+	})
+
+})
@@ -0,0 +1,256 @@
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gotgo/fw/me"
+)
+
+// NamingPolicy - how the assembled file is named in its FolderDestination
+type NamingPolicy int
+
+const (
+	// NameByIdentifier - ChunkFolder.Filename, the flow identifier. The default
+	NameByIdentifier NamingPolicy = iota
+	// NameByOriginal - the sanitized flowFilename
+	NameByOriginal
+	// NameByRelativePath - the sanitized flowRelativePath, rebuilding the client's directory tree
+	NameByRelativePath
+	// NameByTemplate - Naming.Template with its variables expanded
+	NameByTemplate
+)
+
+// CollisionPolicy - what to do when the name is already taken in the destination
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite - replace the existing file. The default
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionFail - fail the assembly with ErrFileExists
+	CollisionFail
+	// CollisionSuffix - append -1, -2.. to the base name until it is free
+	CollisionSuffix
+)
+
+const maxCollisionSuffix = 1000
+
+// ErrFileExists - the assembled file's name is taken and the collision policy is CollisionFail
+var ErrFileExists = errors.New("destination file already exists")
+
+// Naming - naming and collision policy for the assembled file. The zero value keeps the identifier and overwrites.
+// Files of a tenant are placed under a folder named after it, unless Template uses {tenant}.
+type Naming struct {
+	Policy NamingPolicy
+	// Template - for NameByTemplate, for example "{identifier}/{name}". The variables are
+	// {identifier}, {tenant}, {name} (sanitized original filename), {base} (name without extension),
+	// {ext} (extension including the dot), {dir} (sanitized directory of the relative path),
+	// {size}, {sha256}, {yyyy}, {mm}, {dd} (UTC date of assembly) and the keys of
+	// AssembleFolder.Data when it is a map[string]string or map[string]interface{}
+	Template  string
+	Collision CollisionPolicy
+}
+
+// avoidCollision - apply the collision policy to name in destination. Another upload can take the name
+// before the file is written, publish settles it for destinations that rename exclusively.
+func (n *Naming) avoidCollision(name string, destination FolderDestination) (string, error) {
+	if n.Collision == CollisionOverwrite || destination.Size(name) < 0 {
+		return name, nil
+	}
+
+	if n.Collision == CollisionFail {
+		return "", ErrFileExists
+	}
+
+	for i := 1; i <= maxCollisionSuffix; i++ {
+		candidate := suffixed(name, i)
+		if destination.Size(candidate) < 0 {
+			return candidate, nil
+		}
+	}
+	return "", me.Err(ErrFileExists, "no free suffix for filename", &me.KV{"filename", name})
+}
+
+// publish - rename the file stored in destination to chosen, the name avoidCollision picked for name. Unless
+// the policy is CollisionOverwrite a file is never replaced, a name taken meanwhile fails with ErrFileExists
+// or moves on to the next free suffix. Returns the name the file got.
+func (n *Naming) publish(destination FolderDestination, stored, name, chosen string) (string, error) {
+	if n.Collision == CollisionOverwrite || !canRenameExclusive(destination) {
+		return chosen, destination.(Renamer).Rename(stored, chosen)
+	}
+
+	r := destination.(ExclusiveRenamer)
+	candidate := chosen
+	for i := 1; i <= maxCollisionSuffix+1; i++ {
+		err := r.RenameExclusive(stored, candidate)
+		if err != ErrFileExists || n.Collision == CollisionFail {
+			return candidate, err
+		}
+		candidate = suffixed(name, i)
+	}
+	return "", me.Err(ErrFileExists, "no free suffix for filename", &me.KV{"filename", name})
+}
+
+// suffixed - name with -i appended to its base name
+func suffixed(name string, i int) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(i) + ext
+}
+
+func (n *Naming) name(info *UploadInfo) (string, error) {
+	var name string
+	switch n.Policy {
+	case NameByOriginal:
+		name = SanitizeFilename(info.Filename)
+	case NameByRelativePath:
+		if name = SanitizePath(info.RelativePath); name == "" {
+			name = SanitizeFilename(info.Filename)
+		}
+	case NameByTemplate:
+		var err error
+		if name, err = expandKey(n.Template, info); err != nil {
+			return "", err
+		}
+	}
+
+	if name == "" {
+		return info.defaultName(), nil //the chunk folder, already namespaced by the tenant
+	}
+
+	tpl := ""
+	if n.Policy == NameByTemplate {
+		tpl = n.Template
+	}
+	return namespaced(name, tpl, info), nil
+}
+
+// namespaced - name in the folder of the tenant of info, keeping the files of tenants apart, unless the
+// template tpl it was expanded from places the tenant itself
+func namespaced(name, tpl string, info *UploadInfo) string {
+	if info.Tenant == "" || strings.Contains(tpl, "{tenant}") {
+		return name
+	}
+	return escapeTenant(info.Tenant) + "/" + name
+}
+
+// expandKey - expand tpl with the variables of info into a safe relative path
+func expandKey(tpl string, info *UploadInfo) (string, error) {
+	vars, err := templateVars(tpl, info)
+	if err != nil {
+		return "", err
+	}
+	return SanitizePath(expandTemplate(tpl, vars)), nil
+}
+
+// templateVars - the variables for tpl. {sha256} reads the whole file, so it is only computed when tpl uses it
+func templateVars(tpl string, info *UploadInfo) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	//custom variables first, so the built in ones win
+	switch data := info.Data.(type) {
+	case map[string]string:
+		for k, v := range data {
+			vars[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range data {
+			vars[k] = fmt.Sprint(v)
+		}
+	}
+
+	name := SanitizeFilename(info.Filename)
+	ext := path.Ext(name)
+	now := time.Now().UTC()
+	vars["identifier"] = info.Identifier
+	vars["name"] = name
+	vars["base"] = strings.TrimSuffix(name, ext)
+	vars["ext"] = ext
+	vars["dir"] = path.Dir("/" + SanitizePath(info.RelativePath))[1:]
+	vars["size"] = strconv.FormatInt(info.Size, 10)
+	vars["yyyy"] = now.Format("2006")
+	vars["mm"] = now.Format("01")
+	vars["dd"] = now.Format("02")
+	if info.Tenant != "" {
+		vars["tenant"] = escapeTenant(info.Tenant)
+	}
+
+	if strings.Contains(tpl, "{sha256}") {
+		digest, err := info.Sha256()
+		if err != nil {
+			return nil, err
+		}
+		vars["sha256"] = digest
+	}
+	return vars, nil
+}
+
+// expandTemplate - replace every {variable} in tpl, unknown variables expand to nothing
+func expandTemplate(tpl string, vars map[string]string) string {
+	var out strings.Builder
+	for {
+		open := strings.IndexByte(tpl, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(tpl[open:], '}')
+		if end < 0 {
+			break
+		}
+		out.WriteString(tpl[:open])
+		out.WriteString(vars[tpl[open+1:open+end]])
+		tpl = tpl[open+end+1:]
+	}
+	out.WriteString(tpl)
+	return out.String()
+}
+
+// SanitizeFilename - the last element of name, with path separators, control characters and
+// leading dots removed. Returns "" if nothing usable is left.
+func SanitizeFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = path.Base(name)
+
+	clean := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), r == '/', r == ':', r == '*', r == '?', r == '"', r == '<', r == '>', r == '|':
+			return '_'
+		}
+		return r
+	}, name)
+
+	clean = strings.TrimLeft(strings.TrimSpace(clean), ".")
+	if len(clean) > maxFileKeySize {
+		ext := path.Ext(clean)
+		if len(ext) > maxFileKeySize/2 {
+			ext = ""
+		}
+		cut := maxFileKeySize - len(ext)
+		for cut > 0 && !utf8.RuneStart(clean[cut]) {
+			cut--
+		}
+		clean = clean[:cut] + ext
+	}
+	return clean
+}
+
+// SanitizePath - a relative path made of sanitized elements, "." and ".." elements are dropped
+func SanitizePath(p string) string {
+	p = strings.Replace(p, "\\", "/", -1)
+
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		if part == "." || part == ".." {
+			continue
+		}
+		if clean := SanitizeFilename(part); clean != "" {
+			parts = append(parts, clean)
+		}
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,160 @@
+package chunk_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Naming", func() {
+	var folder string
+	var chunks, complete *FileDestination
+	var pipeline *Pipeline
+
+	BeforeEach(func() {
+		pipeline = nil
+		folder, _ = ioutil.TempDir("", "naming")
+		chunks = &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete = &FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	path := func(name string) string {
+		return filepath.Join(complete.FolderRoot, filepath.FromSlash(name))
+	}
+
+	read := func(name string) string {
+		b, _ := ioutil.ReadFile(path(name))
+		return string(b)
+	}
+
+	//existing - files already in the destination
+	existing := func(names ...string) {
+		for _, name := range names {
+			os.MkdirAll(filepath.Dir(path(name)), 0774)
+			Expect(ioutil.WriteFile(path(name), []byte("old"), 0664)).To(Succeed())
+		}
+	}
+
+	//assembleFolder - assemble source to complete and wait for the outcome
+	assembleFolder := func(source *ChunkFolder, naming Naming, data interface{}) *UploadOutcome {
+		fa := &FileAssembler{Pipeline: pipeline}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *UploadOutcome, 1)
+		fa.Post(&AssembleFolder{Source: source, Destination: complete, Naming: naming, Data: data,
+			Callback: func(o *UploadOutcome) { outcomes <- o }})
+
+		var outcome *UploadOutcome
+		Eventually(outcomes, 5*time.Second).Should(Receive(&outcome))
+		return outcome
+	}
+
+	assemble := func(naming Naming, data interface{}) *UploadOutcome {
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 12, ChunkSize: 12, TotalSize: 12, TotalChunks: 1,
+			Identifier: "7-report", Filename: "report.pdf", Destination: chunks}
+		source, err := u.UploadChunk(strings.NewReader("%PDF-1.4 new"))
+		Expect(err).NotTo(HaveOccurred())
+		return assembleFolder(source, naming, data)
+	}
+
+	It("should sanitize original filenames", func() {
+		Expect(SanitizeFilename("photo.jpg")).To(Equal("photo.jpg"))
+		Expect(SanitizeFilename("../../etc/passwd")).To(Equal("passwd"))
+		Expect(SanitizeFilename(`C:\Users\me\report.pdf`)).To(Equal("report.pdf"))
+		Expect(SanitizeFilename(".bashrc")).To(Equal("bashrc"))
+		Expect(SanitizeFilename("a\x00b?.txt")).To(Equal("a_b_.txt"))
+		Expect(SanitizeFilename("..")).To(Equal(""))
+	})
+
+	It("should keep relative paths inside the destination", func() {
+		Expect(SanitizePath("photos/2014/beach.jpg")).To(Equal("photos/2014/beach.jpg"))
+		Expect(SanitizePath("/photos/../../beach.jpg")).To(Equal("photos/beach.jpg"))
+		Expect(SanitizePath(`..\..\windows\win.ini`)).To(Equal("windows/win.ini"))
+	})
+
+	It("should fail on a taken name with CollisionFail", func() {
+		existing("report.pdf")
+		outcome := assemble(Naming{Policy: NameByOriginal, Collision: CollisionFail}, nil)
+		Expect(outcome.Err).To(HaveOccurred())
+		Expect(outcome.Err.Error()).To(ContainSubstring(ErrFileExists.Error()))
+		Expect(read("report.pdf")).To(Equal("old"))
+	})
+
+	It("should pick the first free suffix with CollisionSuffix", func() {
+		existing("report.pdf", "report-1.pdf")
+		outcome := assemble(Naming{Policy: NameByOriginal, Collision: CollisionSuffix}, nil)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Uri).To(Equal(path("report-2.pdf")))
+		for _, name := range []string{"report.pdf", "report-1.pdf"} {
+			Expect(read(name)).To(Equal("old"))
+		}
+	})
+
+	It("should not replace a file another upload published meanwhile", func() {
+		//the rival publishes report.pdf after the name was picked
+		pipeline = &Pipeline{Stages: []*Stage{{Name: "rival", Processor: ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+			existing("report.pdf")
+			return nil
+		})}}}
+
+		outcome := assemble(Naming{Policy: NameByOriginal, Collision: CollisionSuffix}, nil)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Uri).To(Equal(path("report-1.pdf")))
+		Expect(read("report.pdf")).To(Equal("old"))
+		Expect(read("report-1.pdf")).To(Equal("%PDF-1.4 new"))
+
+		os.Remove(path("report.pdf"))
+		outcome = assemble(Naming{Policy: NameByOriginal, Collision: CollisionFail}, nil)
+		Expect(outcome.Err).To(HaveOccurred())
+		Expect(outcome.Err.Error()).To(ContainSubstring(ErrFileExists.Error()))
+		Expect(read("report.pdf")).To(Equal("old"))
+		files, _ := ioutil.ReadDir(complete.FolderRoot)
+		Expect(files).To(HaveLen(2)) //no staged file left behind
+	})
+
+	It("should overwrite by default", func() {
+		existing("report.pdf")
+		outcome := assemble(Naming{Policy: NameByOriginal}, nil)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(read("report.pdf")).To(Equal("%PDF-1.4 new"))
+	})
+
+	It("should expand templates with the upload and Data variables", func() {
+		template := Naming{Policy: NameByTemplate, Template: "{project}/{yyyy}/{base}-{size}{ext}"}
+		outcome := assemble(template, map[string]string{"project": "../apollo"})
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		year := time.Now().UTC().Format("2006")
+		Expect(outcome.Uri).To(Equal(path("apollo/" + year + "/report-12.pdf")))
+
+		outcome = assemble(Naming{Policy: NameByTemplate, Template: "{identifier}/{unknown}{name}"}, nil)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Uri).To(Equal(path("7-report/report.pdf")))
+	})
+
+	It("should place the files of a tenant below its folder unless the template names it", func() {
+		upload := func(naming Naming) *UploadOutcome {
+			u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 3, ChunkSize: 3, TotalSize: 3, TotalChunks: 1,
+				Identifier: "notes", Filename: "notes.txt", Tenant: "acme", Destination: chunks}
+			source, err := u.UploadChunk(strings.NewReader("abc"))
+			Expect(err).NotTo(HaveOccurred())
+			outcome := assembleFolder(source, naming, nil)
+			Expect(outcome.Err).NotTo(HaveOccurred())
+			return outcome
+		}
+		Expect(upload(Naming{Policy: NameByTemplate, Template: "{name}"}).Uri).To(Equal(path("acme/notes.txt")))
+		Expect(upload(Naming{Policy: NameByTemplate, Template: "tenants/{tenant}/{name}"}).Uri).To(Equal(path("tenants/acme/notes.txt")))
+	})
+
+})
@@ -0,0 +1,88 @@
+package chunk
+
+import (
+	"time"
+)
+
+// Observer - hooks into the upload lifecycle, called by ChunkUpload, the flow package and FileAssembler.
+// Embed NopObserver to implement only the hooks you need. Hooks are called synchronously, so they
+// should return quickly.
+type Observer interface {
+	// SessionStarted - the first chunk of an upload session arrived
+	SessionStarted(u *ChunkUpload)
+	// ChunkReceived - a chunk of size bytes was stored, elapsed is the time spent storing it
+	ChunkReceived(u *ChunkUpload, size int64, elapsed time.Duration)
+	// ChunkRejected - a chunk was refused, u is nil when the request could not be parsed
+	ChunkRejected(u *ChunkUpload, reason error)
+	// SessionComplete - all chunks of the session are stored and ready to assemble
+	SessionComplete(u *ChunkUpload, folder *ChunkFolder)
+	// AssemblyStarted - a FileAssembler worker picked up the folder
+	AssemblyStarted(a *AssembleFolder)
+	// AssemblyFinished - assembly is done, outcome.Err is set on failure
+	AssemblyFinished(a *AssembleFolder, outcome *UploadOutcome)
+	// CleanupFailed - chunks or a partial file for identifier could not be removed
+	CleanupFailed(identifier string, err error)
+}
+
+// NopObserver - an Observer that ignores every hook
+type NopObserver struct{}
+
+func (NopObserver) SessionStarted(u *ChunkUpload)                                   {}
+func (NopObserver) ChunkReceived(u *ChunkUpload, size int64, elapsed time.Duration) {}
+func (NopObserver) ChunkRejected(u *ChunkUpload, reason error)                      {}
+func (NopObserver) SessionComplete(u *ChunkUpload, folder *ChunkFolder)             {}
+func (NopObserver) AssemblyStarted(a *AssembleFolder)                               {}
+func (NopObserver) AssemblyFinished(a *AssembleFolder, outcome *UploadOutcome)      {}
+func (NopObserver) CleanupFailed(identifier string, err error)                      {}
+
+// Observers - calls every hook on each observer in order
+type Observers []Observer
+
+func (o Observers) SessionStarted(u *ChunkUpload) {
+	for _, ob := range o {
+		ob.SessionStarted(u)
+	}
+}
+
+func (o Observers) ChunkReceived(u *ChunkUpload, size int64, elapsed time.Duration) {
+	for _, ob := range o {
+		ob.ChunkReceived(u, size, elapsed)
+	}
+}
+
+func (o Observers) ChunkRejected(u *ChunkUpload, reason error) {
+	for _, ob := range o {
+		ob.ChunkRejected(u, reason)
+	}
+}
+
+func (o Observers) SessionComplete(u *ChunkUpload, folder *ChunkFolder) {
+	for _, ob := range o {
+		ob.SessionComplete(u, folder)
+	}
+}
+
+func (o Observers) AssemblyStarted(a *AssembleFolder) {
+	for _, ob := range o {
+		ob.AssemblyStarted(a)
+	}
+}
+
+func (o Observers) AssemblyFinished(a *AssembleFolder, outcome *UploadOutcome) {
+	for _, ob := range o {
+		ob.AssemblyFinished(a, outcome)
+	}
+}
+
+func (o Observers) CleanupFailed(identifier string, err error) {
+	for _, ob := range o {
+		ob.CleanupFailed(identifier, err)
+	}
+}
+
+func observerOrNop(o Observer) Observer {
+	if o == nil {
+		return NopObserver{}
+	}
+	return o
+}
@@ -0,0 +1,376 @@
+package chunk
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gotgo/fw/me"
+)
+
+// ErrorPolicy - what a Pipeline does when a stage fails
+type ErrorPolicy int
+
+const (
+	// ErrorFail - delete the file and its derived files, the upload fails with the stage's error
+	ErrorFail ErrorPolicy = iota
+	// ErrorContinue - keep going with the next stage, the error is listed in UploadOutcome.StageErrors
+	ErrorContinue
+	// ErrorStop - keep the file but skip the remaining stages, the error is listed in UploadOutcome.StageErrors
+	ErrorStop
+)
+
+// Processor - a step run on every assembled file, see Pipeline. Processors must stop when ctx is done,
+// reading through ProcessedFile.Open does. The pipeline does not wait for a processor past its Timeout or
+// the cancel of the assembly: its result is discarded and it can no longer create derived files or set
+// metadata, but it keeps running until it returns.
+type Processor interface {
+	Process(ctx context.Context, f *ProcessedFile) error
+}
+
+// ProcessorFunc - a function used as a Processor
+type ProcessorFunc func(ctx context.Context, f *ProcessedFile) error
+
+func (fn ProcessorFunc) Process(ctx context.Context, f *ProcessedFile) error {
+	return fn(ctx, f)
+}
+
+// Stage - a Processor of a Pipeline
+type Stage struct {
+	Name      string
+	Processor Processor
+	// Timeout - how long the processor may take, zero for no limit
+	Timeout time.Duration
+	// OnError - what happens when the processor fails or times out, rejections always delete the file
+	OnError ErrorPolicy
+	// ContentTypes - optional, the stage only runs on files of these detected types, "image/*" for a family
+	ContentTypes []string
+	// SkipDeduplicated - the stage does not run on uploads a ContentStore already held, for stages whose
+	// derived files were written with the stored copy. Leave it unset on scans and other checks.
+	SkipDeduplicated bool
+}
+
+// Pipeline - processors run in order by the FileAssembler on every assembled file, before the callback.
+// Uploads deduplicated by a ContentStore run the stages too, except those with SkipDeduplicated. When the
+// destination is a Renamer the file is staged under a hidden name and only published once every stage passed.
+type Pipeline struct {
+	Stages []*Stage
+	// Derivatives - where processors write derived files, defaults to the destination of the file
+	Derivatives FolderDestination
+}
+
+// Derived - a file written by a processor
+type Derived struct {
+	Stage string
+	Name  string
+	Uri   string
+}
+
+// StageError - a failed stage
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return "stage " + e.Stage + " failed: " + e.Err.Error()
+}
+
+// RejectedError - a file refused by a processor
+type RejectedError struct {
+	Stage  string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by " + e.Stage + ": " + e.Reason
+}
+
+// Reject - the error a processor returns to refuse the file, it is deleted with everything derived from it
+func Reject(reason string) error {
+	return &RejectedError{Reason: reason}
+}
+
+// IsRejected - true if err is a *RejectedError
+func IsRejected(err error) bool {
+	_, ok := err.(*RejectedError)
+	return ok
+}
+
+// ProcessedFile - an assembled file handed to the processors of a Pipeline
+type ProcessedFile struct {
+	// Info - the upload session, with the detected ContentType and Data of the AssembleFolder
+	Info *UploadInfo
+	// Filename - the name of the file in Destination. It is published under it once every stage passed,
+	// until then Open reads it from where it is staged.
+	Filename    string
+	Uri         string
+	Size        int64
+	Digest      string
+	Destination FolderDestination
+
+	ctx         context.Context
+	stage       string
+	a           *AssembleFolder
+	derivatives FolderDestination
+	out         *stageOutput
+	//stored - the name the file has in Destination while the stages run
+	stored string
+}
+
+// stageOutput - what the stages of a file add to its outcome, guarded since a stage the pipeline stopped
+// waiting for may still be running. An abandoned stage adds nothing more.
+type stageOutput struct {
+	mu        *sync.Mutex
+	abandoned bool
+}
+
+// add - run fn under the lock, false if the stage was abandoned
+func (o *stageOutput) add(fn func()) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.abandoned {
+		return false
+	}
+	fn()
+	return true
+}
+
+func (o *stageOutput) abandon() {
+	o.mu.Lock()
+	o.abandoned = true
+	o.mu.Unlock()
+}
+
+// Open - the content of the file, from Destination when it is a FileOpener and from the chunks otherwise.
+// It is an io.ReaderAt as well when the file Destination opens is one, such as a file of a FileDestination.
+// Reads fail once the stage times out or the assembly is cancelled.
+func (p *ProcessedFile) Open() (io.ReadCloser, error) {
+	var r io.ReadCloser
+	if opener, ok := p.Destination.(FileOpener); ok {
+		var err error
+		name := p.stored
+		if name == "" {
+			name = p.Filename
+		}
+		if r, err = opener.Open(name); err != nil {
+			return nil, me.Err(err, "failed to open assembled file", &me.KV{"filename", p.Filename})
+		}
+	} else {
+		files, err := p.a.Source.Files()
+		if err != nil {
+			return nil, me.Err(err, "failed to list chunks", &me.KV{"identifier", p.Info.Identifier})
+		}
+		r = &chunksReader{files: files}
+	}
+	rc := readCloser{&contextReader{r, p.ctx}, r}
+	if ra, ok := r.(io.ReaderAt); ok {
+		return &contextFile{rc, ra, p.ctx}, nil
+	}
+	return rc, nil
+}
+
+// AvoidCollision - name, or the one the collision policy of the assembly picks when name is taken in
+// destination. A nil destination stands for where Create writes derived files.
+func (p *ProcessedFile) AvoidCollision(name string, destination FolderDestination) (string, error) {
+	if destination == nil {
+		destination = p.derivatives
+	}
+	return p.a.Naming.avoidCollision(name, destination)
+}
+
+// SetMetadata - add a value to UploadOutcome.Metadata, ignored once the stage was abandoned
+func (p *ProcessedFile) SetMetadata(key string, value interface{}) {
+	p.out.add(func() {
+		if p.a.metadata == nil {
+			p.a.metadata = make(map[string]interface{})
+		}
+		p.a.metadata[key] = value
+	})
+}
+
+// Create - a derived file, it is listed in UploadOutcome.Derived and deleted when the file is rejected
+func (p *ProcessedFile) Create(name string) (io.WriteCloser, error) {
+	if !p.out.add(func() {}) {
+		return nil, me.NewErr("stage abandoned", &me.KV{"stage", p.stage}, &me.KV{"name", name})
+	}
+	w, err := p.derivatives.Create(name)
+	if err != nil {
+		return nil, me.Err(err, "failed to create derived file", &me.KV{"name", name})
+	}
+	derived := Derived{Stage: p.stage, Name: name, Uri: p.derivatives.Uri(name)}
+	if !p.out.add(func() { p.a.derived = append(p.a.derived, derived) }) {
+		if !Discard(w) {
+			p.derivatives.Delete(name)
+		}
+		return nil, me.NewErr("stage abandoned", &me.KV{"stage", p.stage}, &me.KV{"name", name})
+	}
+	return w, nil
+}
+
+// DerivedUri - the uri of a derived file named name
+func (p *ProcessedFile) DerivedUri(name string) string {
+	return p.derivatives.Uri(name)
+}
+
+// DerivedSize - the size of the file named name where derived files are written, less than zero if there is none
+func (p *ProcessedFile) DerivedSize(name string) int64 {
+	return p.derivatives.Size(name)
+}
+
+// run - every stage on the assembled file, an error means the file has to be deleted
+func (pl *Pipeline) run(a *AssembleFolder, f *ProcessedFile) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-a.cancel.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	f.a = a
+	f.out = &stageOutput{mu: &sync.Mutex{}}
+	f.derivatives = pl.Derivatives
+	if f.derivatives == nil {
+		f.derivatives = f.Destination
+	}
+
+	for _, s := range pl.Stages {
+		if len(s.ContentTypes) > 0 && !MatchMediaType(s.ContentTypes, f.Info.MediaType()) {
+			continue
+		}
+		if s.SkipDeduplicated && a.deduplicated {
+			continue
+		}
+		err := pl.runStage(ctx, s, f)
+		if a.cancel.isCancelled() {
+			err = ErrAssemblyCancelled
+		}
+		if err == nil {
+			continue
+		}
+
+		if rejected, ok := err.(*RejectedError); ok {
+			rejected.Stage = s.Name
+		} else if err != ErrAssemblyCancelled {
+			err = &StageError{Stage: s.Name, Err: err}
+			if s.OnError != ErrorFail {
+				a.stageErrors = append(a.stageErrors, err.(*StageError))
+				if s.OnError == ErrorStop {
+					return nil
+				}
+				continue
+			}
+		}
+		f.removeDerived()
+		return err
+	}
+	return nil
+}
+
+// runStage - the processor runs on a copy of f of its own, so one the pipeline stopped waiting for cannot
+// see the next stage's. Returns once it finishes or ctx is done, whichever comes first.
+func (pl *Pipeline) runStage(ctx context.Context, s *Stage, f *ProcessedFile) error {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	sf := *f
+	sf.ctx, sf.stage, sf.out = ctx, s.Name, &stageOutput{mu: f.out.mu}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Processor.Process(ctx, &sf)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		sf.out.abandon()
+		err = ctx.Err()
+	}
+	if err != nil && !IsRejected(err) && ctx.Err() == context.DeadlineExceeded {
+		return me.Err(err, "timed out", &me.KV{"timeout", s.Timeout})
+	}
+	return err
+}
+
+// removeDerived - delete what the processors wrote for a file that is not kept, their metadata stays to
+// tell why
+func (p *ProcessedFile) removeDerived() {
+	for _, derived := range p.a.derived {
+		_ = p.derivatives.Delete(derived.Name)
+	}
+	p.a.derived = nil
+}
+
+// contextReader - fails reads once ctx is done
+type contextReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// contextFile - a contextReader that can also be read at an offset
+type contextFile struct {
+	readCloser
+	ra  io.ReaderAt
+	ctx context.Context
+}
+
+func (c *contextFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.ra.ReadAt(p, off)
+}
+
+// chunksReader - the chunks of a folder read one after the other
+type chunksReader struct {
+	files   []FileSource
+	current io.ReadCloser
+}
+
+func (c *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.files) == 0 {
+				return 0, io.EOF
+			}
+			r, err := c.files[0].Open()
+			if err != nil {
+				return 0, me.Err(err, "Failed to open file", &me.KV{"file", c.files[0].Uri()})
+			}
+			c.current, c.files = r, c.files[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunksReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package chunk_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Pipeline", func() {
+	var folder string
+	var chunks, complete *FileDestination
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "pipeline")
+		chunks = &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete = &FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	assemble := func(pipeline *Pipeline) *UploadOutcome {
+		u := &ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: 11, ChunkSize: 11, TotalSize: 11, TotalChunks: 1,
+			Identifier: "doc", Filename: "doc.txt", Destination: chunks}
+		source, err := u.UploadChunk(strings.NewReader("hello world"))
+		Expect(err).NotTo(HaveOccurred())
+
+		fa := &FileAssembler{Pipeline: pipeline}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *UploadOutcome, 1)
+		fa.Post(&AssembleFolder{Source: source, Destination: complete, Callback: func(o *UploadOutcome) { outcomes <- o }})
+
+		var outcome *UploadOutcome
+		Eventually(outcomes, 5*time.Second).Should(Receive(&outcome))
+		return outcome
+	}
+
+	words := ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		f.SetMetadata("words", len(strings.Fields(string(b))))
+
+		w, err := f.Create(f.Filename + ".upper")
+		if err != nil {
+			return err
+		}
+		io.WriteString(w, strings.ToUpper(string(b)))
+		return w.Close()
+	})
+
+	It("should run the stages in order and keep their metadata and derived files", func() {
+		var order []string
+		record := func(name string) Processor {
+			return ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+				order = append(order, name)
+				return nil
+			})
+		}
+		outcome := assemble(&Pipeline{Stages: []*Stage{
+			{Name: "first", Processor: record("first")},
+			{Name: "words", Processor: words},
+			{Name: "images", Processor: record("images"), ContentTypes: []string{"image/*"}},
+			{Name: "last", Processor: record("last")},
+		}})
+
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(order).To(Equal([]string{"first", "last"}))
+		Expect(outcome.Metadata).To(HaveKeyWithValue("words", 2))
+		Expect(outcome.Derived).To(HaveLen(1))
+		b, err := ioutil.ReadFile(filepath.Join(complete.FolderRoot, outcome.Derived[0].Name))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(b)).To(Equal("HELLO WORLD"))
+	})
+
+	It("should publish the file only once every stage passed", func() {
+		var visible []bool
+		check := ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+			visible = append(visible, complete.Size(f.Filename) >= 0)
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			return r.Close()
+		})
+		outcome := assemble(&Pipeline{Stages: []*Stage{{Name: "check", Processor: check}}})
+
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(visible).To(Equal([]bool{false}))
+		b, err := ioutil.ReadFile(filepath.Join(complete.FolderRoot, "doc"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(b)).To(Equal("hello world"))
+		files, _ := ioutil.ReadDir(complete.FolderRoot)
+		Expect(files).To(HaveLen(1)) //nothing staged is left
+	})
+
+	It("should delete a rejected file with everything derived from it", func() {
+		outcome := assemble(&Pipeline{Stages: []*Stage{
+			{Name: "words", Processor: words},
+			{Name: "validate", OnError: ErrorContinue, Processor: ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+				return Reject("not welcome")
+			})},
+		}})
+
+		Expect(IsRejected(outcome.Err)).To(BeTrue())
+		Expect(outcome.Err.(*RejectedError).Stage).To(Equal("validate"))
+		files, _ := ioutil.ReadDir(complete.FolderRoot)
+		Expect(files).To(BeEmpty())
+	})
+
+	It("should apply the error policy of a stage", func() {
+		failing := ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+			return errors.New("broken")
+		})
+		slow := ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		outcome := assemble(&Pipeline{Stages: []*Stage{
+			{Name: "optional", Processor: failing, OnError: ErrorContinue},
+			{Name: "slow", Processor: slow, Timeout: 10 * time.Millisecond, OnError: ErrorStop},
+			{Name: "words", Processor: words},
+		}})
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.StageErrors).To(HaveLen(2))
+		Expect(outcome.StageErrors[1].Stage).To(Equal("slow"))
+		Expect(outcome.Metadata).To(BeEmpty()) //words never ran
+
+		//a stage that ignores its context is left behind, what it adds later is dropped
+		release := make(chan struct{})
+		finished := make(chan error, 1)
+		stuck := ProcessorFunc(func(ctx context.Context, f *ProcessedFile) error {
+			<-release
+			f.SetMetadata("late", true)
+			_, err := f.Create(f.Filename + ".late")
+			finished <- err
+			return nil
+		})
+		os.RemoveAll(folder)
+		outcome = assemble(&Pipeline{Stages: []*Stage{
+			{Name: "stuck", Processor: stuck, Timeout: 10 * time.Millisecond, OnError: ErrorContinue},
+			{Name: "words", Processor: words},
+		}})
+		close(release)
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.StageErrors).To(HaveLen(1))
+		Expect(outcome.Metadata).To(HaveKey("words"))
+		Eventually(finished).Should(Receive(HaveOccurred()))
+		Expect(outcome.Metadata).NotTo(HaveKey("late"))
+		Expect(outcome.Derived).To(HaveLen(1))
+
+		os.RemoveAll(folder)
+		outcome = assemble(&Pipeline{Stages: []*Stage{{Name: "required", Processor: failing}}})
+		Expect(outcome.Err).To(HaveOccurred())
+		Expect(outcome.Err.Error()).To(ContainSubstring("required"))
+		files, _ := ioutil.ReadDir(complete.FolderRoot)
+		Expect(files).To(BeEmpty())
+	})
+})
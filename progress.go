@@ -0,0 +1,80 @@
+package chunk
+
+import (
+	"time"
+)
+
+// AssemblyProgress - a snapshot of a running assembly, passed to AssembleFolder.Progress
+type AssemblyProgress struct {
+	Filename string
+	//BytesCopied - bytes written to the destination so far
+	BytesCopied int64
+	//TotalBytes - sum of the sizes of all chunks
+	TotalBytes int64
+	//Chunk - 1 based index of the chunk being copied
+	Chunk       int
+	TotalChunks int
+	Elapsed     time.Duration
+	//Throughput - bytes per second since the assembly started
+	Throughput float64
+	//ETA - estimated time remaining, zero when unknown
+	ETA time.Duration
+}
+
+// progressWriter - counts the bytes written through it and reports at most once per interval
+type progressWriter struct {
+	notify   func(*AssemblyProgress)
+	interval time.Duration
+	started  time.Time
+	last     time.Time
+	progress AssemblyProgress
+}
+
+func newProgressWriter(filename string, notify func(*AssemblyProgress), interval time.Duration) *progressWriter {
+	if interval <= 0 {
+		interval = progressInterval
+	}
+	now := time.Now()
+	return &progressWriter{
+		notify:   notify,
+		interval: interval,
+		started:  now,
+		last:     now,
+		progress: AssemblyProgress{Filename: filename},
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.progress.BytesCopied += int64(len(b))
+	if time.Since(p.last) >= p.interval {
+		p.emit()
+	}
+	return len(b), nil
+}
+
+// start - record the start of the copy of chunk index (1 based) out of total
+func (p *progressWriter) start(index, total int, totalBytes int64) {
+	p.progress.Chunk = index
+	p.progress.TotalChunks = total
+	p.progress.TotalBytes = totalBytes
+}
+
+// finish - always report the final state, regardless of the interval
+func (p *progressWriter) finish() {
+	p.emit()
+}
+
+func (p *progressWriter) emit() {
+	now := time.Now()
+	p.last = now
+
+	event := p.progress
+	event.Elapsed = now.Sub(p.started)
+	if secs := event.Elapsed.Seconds(); secs > 0 {
+		event.Throughput = float64(event.BytesCopied) / secs
+	}
+	if remaining := event.TotalBytes - event.BytesCopied; remaining > 0 && event.Throughput > 0 {
+		event.ETA = time.Duration(float64(remaining) / event.Throughput * float64(time.Second))
+	}
+	p.notify(&event)
+}
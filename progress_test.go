@@ -0,0 +1,98 @@
+package chunk_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Progress", func() {
+	var folder string
+	var chunks, complete *FileDestination
+
+	BeforeEach(func() {
+		folder, _ = ioutil.TempDir("", "progress")
+		chunks = &FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete = &FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(folder)
+	})
+
+	//assemble - three chunks of 4 bytes, returns the progress events
+	assemble := func(interval time.Duration) []AssemblyProgress {
+		var source *ChunkFolder
+		for i, part := range []string{"abcd", "efgh", "ijkl"} {
+			u := &ChunkUpload{CurrentChunkNumber: i + 1, CurrentChunkSize: 4, ChunkSize: 4, TotalSize: 12, TotalChunks: 3,
+				Identifier: "parts", Filename: "parts.txt", Destination: chunks}
+			var err error
+			source, err = u.UploadChunk(strings.NewReader(part))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(source.IsComplete()).To(BeTrue())
+
+		var mu sync.Mutex
+		var events []AssemblyProgress
+		fa := &FileAssembler{ProgressInterval: interval}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *UploadOutcome, 1)
+		fa.Post(&AssembleFolder{Source: source, Destination: complete,
+			Progress: func(p *AssemblyProgress) {
+				mu.Lock()
+				events = append(events, *p)
+				mu.Unlock()
+			},
+			Callback: func(o *UploadOutcome) { outcomes <- o }})
+
+		var outcome *UploadOutcome
+		Eventually(outcomes, 5*time.Second).Should(Receive(&outcome))
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+
+	It("should report every chunk and the final state", func() {
+		events := assemble(time.Nanosecond)
+		Expect(len(events)).To(BeNumerically(">=", 4)) //one per chunk and the final event
+
+		for i, e := range events {
+			Expect(e.Filename).To(Equal("parts"))
+			Expect(e.TotalBytes).To(Equal(int64(12)))
+			Expect(e.TotalChunks).To(Equal(3))
+			if i > 0 {
+				Expect(e.BytesCopied).To(BeNumerically(">=", events[i-1].BytesCopied))
+				Expect(e.Chunk).To(BeNumerically(">=", events[i-1].Chunk))
+			}
+		}
+		Expect(events[0].Chunk).To(Equal(1))
+		Expect(events[0].BytesCopied).To(Equal(int64(4)))
+
+		last := events[len(events)-1]
+		Expect(last.Chunk).To(Equal(3))
+		Expect(last.BytesCopied).To(Equal(int64(12)))
+		Expect(last.Throughput).To(BeNumerically(">", 0))
+		Expect(last.ETA).To(BeZero())
+
+		//the estimate covers the bytes still to copy
+		Expect(events[0].Throughput).To(BeNumerically(">", 0))
+		Expect(events[0].ETA).To(BeNumerically(">", 0))
+	})
+
+	It("should throttle events to ProgressInterval", func() {
+		events := assemble(time.Hour)
+		Expect(events).To(HaveLen(1))
+		Expect(events[0].BytesCopied).To(Equal(int64(12)))
+		Expect(events[0].Chunk).To(Equal(3))
+	})
+})
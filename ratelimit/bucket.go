@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Budget - a token bucket refilled with Rate tokens per second up to Burst. A zero Rate is no limit.
+type Budget struct {
+	Rate  float64
+	Burst int
+}
+
+func (b Budget) unlimited() bool {
+	return b.Rate <= 0
+}
+
+func (b Budget) burst() float64 {
+	if b.Burst > 0 {
+		return float64(b.Burst)
+	}
+	return math.Max(1, b.Rate) //a second's worth
+}
+
+// bucket - the state of a Budget, safe for concurrent use
+type bucket struct {
+	budget Budget
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(b Budget, now time.Time) *bucket {
+	return &bucket{budget: b, tokens: b.burst(), last: now}
+}
+
+// refill - called with mu held
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.budget.burst(), b.tokens+elapsed.Seconds()*b.budget.Rate)
+		b.last = now
+	}
+}
+
+// wait - how long until n tokens are available, zero if they are now
+func (b *bucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil || b.budget.unlimited() {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= n {
+		return 0
+	}
+	return seconds((n - b.tokens) / b.budget.Rate)
+}
+
+// take - remove n tokens, the balance goes negative when they are not there so later takes wait for the debt
+func (b *bucket) take(n float64, now time.Time) {
+	if b == nil || b.budget.unlimited() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	b.tokens -= n
+}
+
+// full - true if the bucket refilled completely, it then holds no state worth keeping
+func (b *bucket) full(now time.Time) bool {
+	if b == nil || b.budget.unlimited() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.budget.burst()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultIdleTimeout = 10 * time.Minute
+
+// LimitedError - a request refused because its client or the server is over budget
+type LimitedError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return "rate limit exceeded, retry after " + strconv.FormatInt(RetryAfterSeconds(e.RetryAfter), 10) + "s"
+}
+
+// IsLimited - true if err is a *LimitedError
+func IsLimited(err error) bool {
+	_, ok := err.(*LimitedError)
+	return ok
+}
+
+// RetryAfterSeconds - d rounded up to whole seconds for a Retry-After header, at least 1
+func RetryAfterSeconds(d time.Duration) int64 {
+	s := int64((d + time.Second - 1) / time.Second)
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// Limiter - request and byte budgets, each per client key and for the whole server. A zero Budget is no limit.
+type Limiter struct {
+	// Requests - requests per second of one client
+	Requests Budget
+	// GlobalRequests - requests per second of all clients together
+	GlobalRequests Budget
+	// Bytes - bytes per second one client may upload
+	Bytes Budget
+	// GlobalBytes - bytes per second of all uploads together
+	GlobalBytes Budget
+	// IdleTimeout - state of a client not seen for this long is dropped once its budgets refilled,
+	// defaults to ten minutes
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	global  *client
+	clients map[string]*client
+	swept   time.Time
+}
+
+type client struct {
+	requests *bucket
+	bytes    *bucket
+	seen     time.Time
+}
+
+func (l *Limiter) newClient(requests, bytes Budget, now time.Time) *client {
+	return &client{requests: newBucket(requests, now), bytes: newBucket(bytes, now), seen: now}
+}
+
+// get - the state of key and of the server, called with mu held
+func (l *Limiter) get(key string, now time.Time) (*client, *client) {
+	if l.global == nil {
+		l.global = l.newClient(l.GlobalRequests, l.GlobalBytes, now)
+		l.clients = make(map[string]*client)
+		l.swept = now
+	}
+	l.sweep(now)
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = l.newClient(l.Requests, l.Bytes, now)
+		l.clients[key] = c
+	}
+	c.seen = now
+	return c, l.global
+}
+
+// sweep - drop idle clients, at most once per IdleTimeout. A dropped client comes back with full budgets,
+// which it had anyway. Called with mu held.
+func (l *Limiter) sweep(now time.Time) {
+	idle := l.IdleTimeout
+	if idle <= 0 {
+		idle = defaultIdleTimeout
+	}
+	if now.Sub(l.swept) < idle {
+		return
+	}
+	l.swept = now
+	for key, c := range l.clients {
+		if now.Sub(c.seen) >= idle && c.requests.full(now) && c.bytes.full(now) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// Allow - take a request from the budgets of key and the server, a *LimitedError telling how long to wait
+// when either is used up. Refused requests cost nothing.
+func (l *Limiter) Allow(key string) error {
+	if l == nil || (l.Requests.unlimited() && l.GlobalRequests.unlimited()) {
+		return nil
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, global := l.get(key, now)
+	wait := c.requests.wait(1, now)
+	if w := global.requests.wait(1, now); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		return &LimitedError{Key: key, RetryAfter: wait}
+	}
+	c.requests.take(1, now)
+	global.requests.take(1, now)
+	return nil
+}
+
+// Reader - src slowed down to the byte budgets of key and the server. Waiting stops with the error of ctx
+// when it is done, e.g. when the client went away.
+func (l *Limiter) Reader(ctx context.Context, key string, src io.Reader) io.Reader {
+	if l == nil || (l.Bytes.unlimited() && l.GlobalBytes.unlimited()) {
+		return src
+	}
+	l.mu.Lock()
+	c, global := l.get(key, time.Now())
+	l.mu.Unlock()
+
+	max := 0
+	for _, b := range []Budget{l.Bytes, l.GlobalBytes} {
+		if !b.unlimited() && (max == 0 || int(b.burst()) < max) {
+			max = int(b.burst())
+		}
+	}
+	return &reader{src: src, ctx: ctx, buckets: []*bucket{c.bytes, global.bytes}, max: max}
+}
+
+// reader - reads at most max bytes at a time and pays for them before returning
+type reader struct {
+	src     io.Reader
+	ctx     context.Context
+	buckets []*bucket
+	max     int
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	n, err := r.src.Read(p)
+	if n <= 0 {
+		return n, err
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range r.buckets {
+		b.take(float64(n), now)
+		if w := b.wait(0, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
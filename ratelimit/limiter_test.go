@@ -0,0 +1,63 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"time"
+
+	. "github.com/gotgo/chunk/ratelimit"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limiter", func() {
+
+	It("should allow the burst of a client and then tell it when to retry", func() {
+		l := &Limiter{Requests: Budget{Rate: 1, Burst: 3}}
+		for i := 0; i < 3; i++ {
+			Expect(l.Allow("a")).To(Succeed())
+		}
+		err := l.Allow("a")
+		Expect(IsLimited(err)).To(BeTrue())
+		Expect(err.(*LimitedError).RetryAfter).To(BeNumerically(">", 0))
+		Expect(err.(*LimitedError).RetryAfter).To(BeNumerically("<=", time.Second))
+
+		Expect(l.Allow("b")).To(Succeed()) //budgets are per client
+	})
+
+	It("should share the global budget between clients", func() {
+		l := &Limiter{Requests: Budget{Rate: 100, Burst: 100}, GlobalRequests: Budget{Rate: 1, Burst: 2}}
+		Expect(l.Allow("a")).To(Succeed())
+		Expect(l.Allow("b")).To(Succeed())
+		Expect(IsLimited(l.Allow("c"))).To(BeTrue())
+	})
+
+	It("should slow a reader down to the byte rate", func() {
+		l := &Limiter{Bytes: Budget{Rate: 2000, Burst: 100}}
+		src := bytes.NewReader(make([]byte, 500))
+
+		started := time.Now()
+		n, err := io.Copy(ioutil.Discard, l.Reader(context.Background(), "a", src))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(Equal(int64(500)))
+		//the burst is free, the remaining 400 bytes take 200ms
+		Expect(time.Since(started)).To(BeNumerically(">=", 150*time.Millisecond))
+	})
+
+	It("should stop waiting when the context is done", func() {
+		l := &Limiter{GlobalBytes: Budget{Rate: 10, Burst: 10}}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := io.Copy(ioutil.Discard, l.Reader(ctx, "a", bytes.NewReader(make([]byte, 100))))
+		Expect(err).To(Equal(context.Canceled))
+	})
+
+	It("should pass everything when there are no budgets", func() {
+		var l *Limiter
+		Expect(l.Allow("a")).To(Succeed())
+		src := bytes.NewReader(nil)
+		Expect(l.Reader(context.Background(), "a", src)).To(BeIdenticalTo(src))
+	})
+})
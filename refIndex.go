@@ -0,0 +1,123 @@
+package chunk
+
+import "sync"
+
+// RefIndex - reference counts of stored content, by key
+type RefIndex interface {
+	// Add - take a reference on key, returns the new count
+	Add(key string) (int, error)
+	// Release - drop a reference on key, returns the remaining count
+	Release(key string) (int, error)
+	// Count - references held on key
+	Count(key string) (int, error)
+}
+
+// MemoryRefIndex - a RefIndex that is lost on restart
+type MemoryRefIndex struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *MemoryRefIndex) Add(key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int)
+	}
+	m.counts[key]++
+	return m.counts[key], nil
+}
+
+func (m *MemoryRefIndex) Release(key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	count := m.counts[key] - 1
+	if count <= 0 {
+		delete(m.counts, key)
+		return 0, nil
+	}
+	m.counts[key] = count
+	return count, nil
+}
+
+func (m *MemoryRefIndex) Count(key string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[key], nil
+}
+
+// FileRefIndex - a RefIndex kept in a JSON file at Path, rewritten atomically on every change
+type FileRefIndex struct {
+	Path string
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (f *FileRefIndex) Add(key string) (int, error) {
+	return f.change(key, 1)
+}
+
+func (f *FileRefIndex) Release(key string) (int, error) {
+	return f.change(key, -1)
+}
+
+func (f *FileRefIndex) Count(key string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.counts[key], nil
+}
+
+func (f *FileRefIndex) change(key string, delta int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+
+	previous := f.counts[key]
+	count := previous + delta
+	if count <= 0 {
+		count = 0
+		delete(f.counts, key)
+	} else {
+		f.counts[key] = count
+	}
+
+	if err := f.save(); err != nil {
+		//keep memory in line with the file
+		if previous > 0 {
+			f.counts[key] = previous
+		} else {
+			delete(f.counts, key)
+		}
+		return previous, err
+	}
+	return count, nil
+}
+
+// load - read the file once, called with mu held
+func (f *FileRefIndex) load() error {
+	if f.counts != nil {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	if err := f.file().load(&counts); err != nil {
+		return err
+	}
+	f.counts = counts
+	return nil
+}
+
+// save - replace the index file, called with mu held
+func (f *FileRefIndex) save() error {
+	return f.file().save(f.counts)
+}
+
+func (f *FileRefIndex) file() jsonFile {
+	return jsonFile{path: f.Path, what: "reference index"}
+}
@@ -0,0 +1,166 @@
+package chunk
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// ErrNoRoute - no rule of a Router matched and it has no Default
+var ErrNoRoute = errors.New("no route matches the upload")
+
+// ErrAmbiguousRoute - a Router cannot tell the destination of a file from its name alone, because a rule
+// that could match depends on its size, content type or Match
+var ErrAmbiguousRoute = errors.New("route cannot be decided by the filename")
+
+// Resolver - implemented by destinations that pick the actual FolderDestination and filename from what
+// is known about the upload. filename is the name chosen by AssembleFolder.Naming.
+type Resolver interface {
+	Resolve(info *UploadInfo, filename string) (FolderDestination, string, error)
+}
+
+// Rule - one route of a Router. Every condition that is set must hold for the rule to match.
+type Rule struct {
+	//MinSize, MaxSize - inclusive bounds on the file size, zero for no bound
+	MinSize int64
+	MaxSize int64
+	//Extensions - lower case with the dot, ".jpg"
+	Extensions []string
+	//ContentTypes - detected media types, "video/mp4" or a whole family "image/*"
+	ContentTypes []string
+	//Match - custom condition, typically on UploadInfo.Data
+	Match func(info *UploadInfo) bool
+
+	//KeyTemplate - the filename in Destination, for example "{tenant}/{yyyy}/{mm}/{sha256}{ext}". See
+	//Naming.Template for the variables. Keys of a tenant's uploads are placed under a folder named after it,
+	//unless the template uses {tenant}. Empty keeps the name chosen by AssembleFolder.Naming
+	KeyTemplate string
+	Destination FolderDestination
+}
+
+func (r *Rule) matches(info *UploadInfo) bool {
+	if r.MinSize > 0 && info.Size < r.MinSize {
+		return false
+	}
+	if r.MaxSize > 0 && info.Size > r.MaxSize {
+		return false
+	}
+	if len(r.Extensions) > 0 && !containsFold(r.Extensions, info.Ext()) {
+		return false
+	}
+	if len(r.ContentTypes) > 0 && !MatchMediaType(r.ContentTypes, info.MediaType()) {
+		return false
+	}
+	if r.Match != nil && !r.Match(info) {
+		return false
+	}
+	return true
+}
+
+// Router - a FolderDestination that sends each assembled file to the destination of the first matching
+// Rule, or to Default. The assembler resolves every file with all that is known about it. The plain
+// FolderDestination methods only see a filename, they work while the rules that could match it only
+// depend on Extensions and fail with ErrAmbiguousRoute otherwise; use the rule's Destination directly then.
+type Router struct {
+	Rules   []*Rule
+	Default FolderDestination
+}
+
+func (r *Router) Resolve(info *UploadInfo, filename string) (FolderDestination, string, error) {
+	for _, rule := range r.Rules {
+		if !rule.matches(info) {
+			continue
+		}
+		if rule.KeyTemplate == "" {
+			return rule.Destination, filename, nil
+		}
+		key, err := expandKey(rule.KeyTemplate, info)
+		if err != nil {
+			return nil, "", err
+		}
+		return rule.Destination, namespaced(key, rule.KeyTemplate, info), nil
+	}
+
+	if r.Default == nil {
+		return nil, "", ErrNoRoute
+	}
+	return r.Default, filename, nil
+}
+
+// route - the destination for a bare filename, for the FolderDestination methods. Rules on Extensions are
+// decided by the name, ErrAmbiguousRoute is returned when a rule with other conditions could match first.
+func (r *Router) route(filename string) (FolderDestination, error) {
+	ext := strings.ToLower(path.Ext(filename))
+	for _, rule := range r.Rules {
+		if len(rule.Extensions) > 0 && !containsFold(rule.Extensions, ext) {
+			continue
+		}
+		if rule.MinSize > 0 || rule.MaxSize > 0 || len(rule.ContentTypes) > 0 || rule.Match != nil {
+			return nil, ErrAmbiguousRoute
+		}
+		return rule.Destination, nil
+	}
+
+	if r.Default == nil {
+		return nil, ErrNoRoute
+	}
+	return r.Default, nil
+}
+
+func (r *Router) Create(filename string) (io.WriteCloser, error) {
+	d, err := r.route(filename)
+	if err != nil {
+		return nil, err
+	}
+	return d.Create(filename)
+}
+
+func (r *Router) Delete(filename string) error {
+	d, err := r.route(filename)
+	if err != nil {
+		return err
+	}
+	return d.Delete(filename)
+}
+
+// Uri - empty when the route cannot be decided by filename
+func (r *Router) Uri(filename string) string {
+	d, err := r.route(filename)
+	if err != nil {
+		return ""
+	}
+	return d.Uri(filename)
+}
+
+// Size - less than zero when the route cannot be decided by filename
+func (r *Router) Size(filename string) int64 {
+	d, err := r.route(filename)
+	if err != nil {
+		return -1
+	}
+	return d.Size(filename)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchMediaType - true if mediaType is one of patterns, "image/*" matches the whole family
+func MatchMediaType(patterns []string, mediaType string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+		} else if strings.EqualFold(p, mediaType) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package chunk_test
+
+import (
+	. "github.com/gotgo/chunk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Router", func() {
+	videos := &MockDestination{}
+	images := &MockDestination{}
+	other := &MockDestination{}
+	router := &Router{
+		Rules: []*Rule{
+			{ContentTypes: []string{"video/*"}, MinSize: 1000, Destination: videos, KeyTemplate: "{tenant}/{base}-{size}{ext}"},
+			{Extensions: []string{".png", ".jpg"}, Destination: images},
+		},
+		Default: other,
+	}
+
+	It("should route by content type and size with a key template", func() {
+		info := &UploadInfo{Filename: "clip.MP4", Size: 2000, ContentType: "video/mp4", Data: map[string]string{"tenant": "acme"}}
+		d, key, err := router.Resolve(info, "abcdefg")
+		Expect(err).To(BeNil())
+		Expect(d).To(BeIdenticalTo(videos))
+		Expect(key).To(Equal("acme/clip-2000.MP4"))
+	})
+
+	It("should keep the keys of tenants apart", func() {
+		tenants := &Router{Rules: []*Rule{{Destination: images, KeyTemplate: "{base}{ext}"}}}
+		_, key, err := tenants.Resolve(&UploadInfo{Filename: "logo.png", Tenant: "acme"}, "abcdefg")
+		Expect(err).To(BeNil())
+		Expect(key).To(Equal("acme/logo.png"))
+
+		_, key, err = router.Resolve(&UploadInfo{Filename: "clip.mp4", Size: 2000, ContentType: "video/mp4", Tenant: "acme",
+			Data: map[string]string{"tenant": "other"}}, "abcdefg")
+		Expect(err).To(BeNil())
+		Expect(key).To(Equal("acme/clip-2000.mp4"))
+	})
+
+	It("should keep the filename when the rule has no template", func() {
+		d, key, err := router.Resolve(&UploadInfo{Filename: "photo.JPG", ContentType: "image/jpeg"}, "abcdefg")
+		Expect(err).To(BeNil())
+		Expect(d).To(BeIdenticalTo(images))
+		Expect(key).To(Equal("abcdefg"))
+	})
+
+	It("should fall back to the default", func() {
+		d, _, err := router.Resolve(&UploadInfo{Filename: "clip.mp4", Size: 10, ContentType: "video/mp4"}, "abcdefg")
+		Expect(err).To(BeNil())
+		Expect(d).To(BeIdenticalTo(other))
+
+		_, _, err = (&Router{}).Resolve(&UploadInfo{}, "abcdefg")
+		Expect(err).To(Equal(ErrNoRoute))
+	})
+
+	It("should only route bare filenames it can decide by name", func() {
+		//any file could be a large video
+		Expect(router.Size("photo.JPG")).To(BeNumerically("<", 0))
+		Expect(router.Delete("clip.mp4")).To(Equal(ErrAmbiguousRoute))
+		_, err := router.Create("notes.txt")
+		Expect(err).To(Equal(ErrAmbiguousRoute))
+
+		byName := &Router{Rules: []*Rule{
+			{Extensions: []string{".png"}, Destination: images},
+			{Extensions: []string{".mp4"}, MinSize: 1000, Destination: videos},
+		}, Default: &MockDestination{fileSize: 3}}
+		images.fileSize = 7
+		Expect(byName.Size("photo.PNG")).To(Equal(int64(7)))
+		Expect(byName.Size("notes.txt")).To(Equal(int64(3)))
+		Expect(byName.Size("clip.mp4")).To(BeNumerically("<", 0))
+		_, err = (&Router{}).Create("notes.txt")
+		Expect(err).To(Equal(ErrNoRoute))
+	})
+
+})
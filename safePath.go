@@ -0,0 +1,87 @@
+package chunk
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UnsafePathError - a subfolder or filename that would resolve outside of FileDestination.FolderRoot
+type UnsafePathError struct {
+	Root   string
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return "unsafe path " + e.Reason + ": " + e.Path + " (root " + e.Root + ")"
+}
+
+// IsUnsafePath - true if err is an *UnsafePathError
+func IsUnsafePath(err error) bool {
+	_, ok := err.(*UnsafePathError)
+	return ok
+}
+
+// resolveInside - join the relative names onto root and verify the result stays inside root, also after
+// following the symlinks of the parts that already exist. Returns the joined path, not the symlink target.
+func resolveInside(root string, names ...string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", &UnsafePathError{Root: root, Path: filepath.Join(names...), Reason: "root not resolvable"}
+	}
+
+	for _, name := range names {
+		if strings.IndexByte(name, 0) >= 0 {
+			return "", &UnsafePathError{Root: root, Path: name, Reason: "contains NUL"}
+		}
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) || filepath.VolumeName(name) != "" {
+			return "", &UnsafePathError{Root: root, Path: name, Reason: "is absolute"}
+		}
+	}
+
+	joined := filepath.Join(append([]string{root}, names...)...)
+	if !within(root, joined) {
+		return "", &UnsafePathError{Root: root, Path: joined, Reason: "escapes root"}
+	}
+
+	//a symlink anywhere below the root could point outside of it
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		//the root does not exist yet, so nothing below it can be a symlink
+		return joined, nil
+	}
+
+	existing := deepestExisting(joined)
+	realExisting, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", &UnsafePathError{Root: root, Path: joined, Reason: "symlink not resolvable"}
+	}
+	if !within(realRoot, realExisting) {
+		return "", &UnsafePathError{Root: root, Path: joined, Reason: "symlink escapes root"}
+	}
+	return joined, nil
+}
+
+// within - true if p is root or below root, both clean and absolute
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// deepestExisting - p or the closest of its parents that exists
+func deepestExisting(p string) string {
+	for {
+		if _, err := os.Lstat(p); err == nil {
+			return p
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p
+		}
+		p = parent
+	}
+}
@@ -0,0 +1,136 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gotgo/fw/me"
+)
+
+const (
+	defaultNetwork   = "tcp"
+	defaultAddress   = "127.0.0.1:3310"
+	defaultChunkSize = 64 << 10
+	maxReplySize     = 4 << 10
+)
+
+// Clamd - a Scanner talking to clamd, or anything speaking its INSTREAM protocol, over a unix or tcp socket
+type Clamd struct {
+	// Network - "unix" or "tcp", defaults to tcp
+	Network string
+	// Address - the socket path or host:port, defaults to 127.0.0.1:3310
+	Address string
+	// ChunkSize - bytes sent per INSTREAM chunk, defaults to 64KB. Must stay below clamd's StreamMaxLength.
+	ChunkSize int
+}
+
+// Scan - stream r to clamd with INSTREAM and read back the verdict. The connection is closed when ctx is done.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*Verdict, error) {
+	network, address := c.Network, c.Address
+	if network == "" {
+		network = defaultNetwork
+	}
+	if address == "" {
+		address = defaultAddress
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, me.Err(err, "failed to connect to scanner", &me.KV{"address", address})
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0)) //unblock reads and writes
+		case <-stop:
+		}
+	}()
+
+	if err = c.stream(conn, r); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, me.Err(err, "failed to read scanner reply", &me.KV{"address", address})
+	}
+	return parseReply(reply)
+}
+
+// stream - the INSTREAM command, r in length prefixed chunks and a zero length chunk to end it
+func (c *Clamd) stream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return me.Err(err, "failed to send scan command")
+	}
+
+	size := c.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	buf := make([]byte, 4+size)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				//clamd hangs up once the stream exceeds its limit, its reply tells so
+				if reply, rerr := readReply(conn); rerr == nil {
+					_, perr := parseReply(reply)
+					return perr
+				}
+				return me.Err(werr, "failed to stream file to scanner")
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return me.Err(err, "failed to read file to scan")
+		}
+	}
+
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// readReply - the null terminated reply of a z command
+func readReply(conn net.Conn) (string, error) {
+	b, err := bufio.NewReader(io.LimitReader(conn, maxReplySize)).ReadBytes(0)
+	if err != nil && len(b) == 0 {
+		return "", err
+	}
+	return strings.TrimSpace(string(bytes.TrimSuffix(b, []byte{0}))), nil
+}
+
+// parseReply - "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+func parseReply(reply string) (*Verdict, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return &Verdict{Status: StatusClean}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &Verdict{Status: StatusInfected, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return nil, me.NewErr("scanner failed", &me.KV{"reply", reply})
+	}
+}
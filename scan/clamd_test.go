@@ -0,0 +1,176 @@
+package scan_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/scan"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// standIn - speaks the clamd INSTREAM protocol, finding the EICAR test string
+func standIn() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l, nil
+}
+
+func serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND ERROR\x00"))
+		return
+	}
+
+	var content bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return
+		}
+	}
+	if bytes.Contains(content.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+// silentStandIn - accepts connections and reads what is sent, but never replies
+func silentStandIn() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	return l, nil
+}
+
+var _ = Describe("Scan", func() {
+	var folder string
+	var listener net.Listener
+	var chunks, complete, quarantine *chunk.FileDestination
+
+	BeforeEach(func() {
+		var err error
+		listener, err = standIn()
+		Expect(err).NotTo(HaveOccurred())
+		folder, _ = ioutil.TempDir("", "scan")
+		chunks = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "incomplete")}
+		complete = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "complete")}
+		quarantine = &chunk.FileDestination{FolderRoot: filepath.Join(folder, "quarantine")}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		os.RemoveAll(folder)
+	})
+
+	assemble := func(processor *Processor, identifier, content string) *chunk.UploadOutcome {
+		size := len(content)
+		u := &chunk.ChunkUpload{CurrentChunkNumber: 1, CurrentChunkSize: size, ChunkSize: size, TotalSize: int64(size), TotalChunks: 1,
+			Identifier: identifier, Filename: identifier + ".txt", Destination: chunks}
+		source, err := u.UploadChunk(strings.NewReader(content))
+		Expect(err).NotTo(HaveOccurred())
+
+		fa := &chunk.FileAssembler{Pipeline: &chunk.Pipeline{Stages: []*chunk.Stage{{Name: "scan", Processor: processor, Timeout: 5 * time.Second}}}}
+		fa.Start()
+		defer fa.Stop()
+		outcomes := make(chan *chunk.UploadOutcome, 1)
+		fa.Post(&chunk.AssembleFolder{Source: source, Destination: complete, Callback: func(o *chunk.UploadOutcome) { outcomes <- o }})
+
+		var outcome *chunk.UploadOutcome
+		Eventually(outcomes, 5*time.Second).Should(Receive(&outcome))
+		return outcome
+	}
+
+	It("should deliver clean files", func() {
+		clamd := &Clamd{Address: listener.Addr().String(), ChunkSize: 4}
+		outcome := assemble(&Processor{Scanner: clamd, Quarantine: quarantine}, "clean", "nothing to see here")
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Metadata[MetadataKey].(*Verdict).Status).To(Equal(StatusClean))
+		Expect(complete.Size("clean")).To(Equal(int64(19)))
+	})
+
+	It("should quarantine infected files instead of delivering them", func() {
+		clamd := &Clamd{Address: listener.Addr().String(), ChunkSize: 16}
+		outcome := assemble(&Processor{Scanner: clamd, Quarantine: quarantine}, "infected", eicar)
+		Expect(chunk.IsRejected(outcome.Err)).To(BeTrue())
+		Expect(outcome.Uri).To(BeEmpty())
+
+		verdict := outcome.Metadata[MetadataKey].(*Verdict)
+		Expect(verdict.Status).To(Equal(StatusInfected))
+		Expect(verdict.Signature).To(Equal("Eicar-Test-Signature"))
+		Expect(verdict.Quarantined).NotTo(BeEmpty())
+		Expect(complete.Size("infected")).To(Equal(int64(-1)))
+		Expect(quarantine.Size("infected")).To(Equal(int64(len(eicar))))
+	})
+
+	It("should fail open or closed when the scanner is down", func() {
+		address := listener.Addr().String()
+		listener.Close()
+		clamd := &Clamd{Address: address}
+
+		outcome := assemble(&Processor{Scanner: clamd}, "closed", "unchecked")
+		Expect(outcome.Err).To(HaveOccurred())
+		Expect(complete.Size("closed")).To(Equal(int64(-1)))
+
+		outcome = assemble(&Processor{Scanner: clamd, FailOpen: true}, "open", "unchecked")
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Metadata[MetadataKey].(*Verdict).Status).To(Equal(StatusError))
+		Expect(complete.Size("open")).To(Equal(int64(9)))
+	})
+	It("should fail open when the scanner does not answer in time", func() {
+		silent, err := silentStandIn()
+		Expect(err).NotTo(HaveOccurred())
+		defer silent.Close()
+		clamd := &Clamd{Address: silent.Addr().String()}
+
+		outcome := assemble(&Processor{Scanner: clamd, Timeout: 50 * time.Millisecond}, "closed", "unchecked")
+		Expect(outcome.Err).To(HaveOccurred())
+		Expect(complete.Size("closed")).To(Equal(int64(-1)))
+
+		outcome = assemble(&Processor{Scanner: clamd, FailOpen: true, Timeout: 50 * time.Millisecond}, "open", "unchecked")
+		Expect(outcome.Err).NotTo(HaveOccurred())
+		Expect(outcome.Metadata[MetadataKey].(*Verdict).Status).To(Equal(StatusError))
+		Expect(complete.Size("open")).To(Equal(int64(9)))
+	})
+})
@@ -0,0 +1,112 @@
+package scan
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/fw/me"
+)
+
+// MetadataKey - the UploadOutcome.Metadata entry holding the *Verdict
+const MetadataKey = "scan"
+
+// Verdict statuses
+const (
+	StatusClean    = "clean"
+	StatusInfected = "infected"
+	// StatusError - the scanner could not be reached or failed, only reported when failing open
+	StatusError = "error"
+)
+
+// Verdict - the result of scanning a file
+type Verdict struct {
+	Status    string `json:"status"`
+	Signature string `json:"signature,omitempty"`
+	// Quarantined - uri of the copy kept of an infected file
+	Quarantined string `json:"quarantined,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Scanner - checks a stream for malware
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*Verdict, error)
+}
+
+// Processor - a chunk.Processor scanning every assembled file, put it first in the Pipeline so nothing is
+// derived from an infected file. Infected files are copied to Quarantine and rejected, so the upload fails
+// and the file is deleted. The verdict is in UploadOutcome.Metadata under MetadataKey.
+type Processor struct {
+	Scanner Scanner
+	// Quarantine - optional, where infected files are kept, named by their destination filename
+	Quarantine chunk.FolderDestination
+	// FailOpen - deliver files the scanner could not check, also when it did not answer within Timeout. By
+	// default they fail with the scanner's error. A cancelled assembly always fails.
+	FailOpen bool
+	// Timeout - optional, how long a scan may take. Keep it below the Timeout of the Stage, the pipeline
+	// stops waiting for the stage at that point and FailOpen cannot deliver the file anymore.
+	Timeout time.Duration
+}
+
+func (p *Processor) Process(ctx context.Context, f *chunk.ProcessedFile) error {
+	scanCtx := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	verdict, err := p.scan(scanCtx, f)
+	if err != nil {
+		if p.FailOpen && ctx.Err() != context.Canceled {
+			f.SetMetadata(MetadataKey, &Verdict{Status: StatusError, Error: err.Error()})
+			return nil
+		}
+		return err
+	}
+	if verdict.Status == StatusInfected && p.Quarantine != nil {
+		verdict.Quarantined, err = p.quarantine(f)
+	}
+	f.SetMetadata(MetadataKey, verdict)
+	if err != nil || verdict.Status != StatusInfected {
+		return err
+	}
+	return chunk.Reject("infected with " + verdict.Signature)
+}
+
+func (p *Processor) scan(ctx context.Context, f *chunk.ProcessedFile) (*Verdict, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return p.Scanner.Scan(ctx, r)
+}
+
+// quarantine - copy the file to Quarantine, returns the uri of the copy
+func (p *Processor) quarantine(f *chunk.ProcessedFile) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	w, err := p.Quarantine.Create(f.Filename)
+	if err != nil {
+		return "", me.Err(err, "failed to create quarantine file", &me.KV{"filename", f.Filename})
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		if !chunk.Discard(w) {
+			p.Quarantine.Delete(f.Filename)
+		}
+		return "", me.Err(err, "failed to quarantine file", &me.KV{"filename", f.Filename})
+	}
+	if err = w.Close(); err != nil {
+		if chunk.LeftBehind(w) {
+			p.Quarantine.Delete(f.Filename)
+		}
+		return "", me.Err(err, "failed to quarantine file", &me.KV{"filename", f.Filename})
+	}
+	return p.Quarantine.Uri(f.Filename), nil
+}
@@ -0,0 +1,121 @@
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gotgo/fw/me"
+)
+
+const maxShardLevels = 4
+
+// shard - the hash prefix folders of name, two hex characters per level
+func shard(name string, levels int) []string {
+	if levels <= 0 {
+		return nil
+	}
+	if levels > maxShardLevels {
+		levels = maxShardLevels
+	}
+
+	sum := sha256.Sum256([]byte(filepath.ToSlash(filepath.Clean(name))))
+	h := hex.EncodeToString(sum[:levels])
+	prefixes := make([]string, levels)
+	for i := range prefixes {
+		prefixes[i] = h[i*2 : i*2+2]
+	}
+	return prefixes
+}
+
+// MigrateSessions - move the session folders of a flat layout into their shard folders, for a
+// FileDestination holding chunks whose ShardLevels was just set. A session folder is the folder holding
+// its chunks, so the sessions of a tenant are sharded by their SessionKey. Returns the number of files
+// moved.
+func (f *FileDestination) MigrateSessions() (int, error) {
+	return f.migrate(func(rel string) string {
+		if folder := path.Dir(rel); folder != "." {
+			return folder
+		}
+		return rel
+	})
+}
+
+// MigrateFiles - move the assembled files of a flat layout into their shard folders, for a FileDestination
+// holding complete files whose ShardLevels was just set. Returns the number of files moved.
+func (f *FileDestination) MigrateFiles() (int, error) {
+	return f.migrate(func(rel string) string {
+		return rel
+	})
+}
+
+// migrate - move every file that is not below the shard folders of its key, then drop emptied folders.
+// Files already in place are left alone, so an interrupted migration can be run again.
+func (f *FileDestination) migrate(key func(rel string) string) (int, error) {
+	if f.ShardLevels <= 0 {
+		return 0, me.NewErr("ShardLevels not set", &me.KV{"root", f.FolderRoot})
+	}
+	root, err := filepath.Abs(f.root())
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	err = filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if f.sharded(rel, key) {
+			return nil
+		}
+
+		target := filepath.Join(append(append([]string{root}, shard(key(rel), f.ShardLevels)...), rel)...)
+		if err = os.MkdirAll(filepath.Dir(target), 0774); err != nil {
+			return me.Err(err, "failed to create shard folder", &me.KV{"path", target})
+		}
+		if err = os.Rename(p, target); err != nil {
+			return me.Err(err, "failed to move file into its shard", &me.KV{"from", p}, &me.KV{"to", target})
+		}
+		moved++
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+	return moved, removeEmptyFolders(root)
+}
+
+// sharded - true if rel already sits below the shard folders of its key
+func (f *FileDestination) sharded(rel string, key func(string) string) bool {
+	parts := strings.SplitN(rel, "/", f.ShardLevels+1)
+	if len(parts) <= f.ShardLevels {
+		return false
+	}
+	return strings.Join(parts[:f.ShardLevels], "/") == strings.Join(shard(key(parts[f.ShardLevels]), f.ShardLevels), "/")
+}
+
+// removeEmptyFolders - delete every empty folder below root, deepest first
+func removeEmptyFolders(root string) error {
+	var folders []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && p != root {
+			folders = append(folders, p)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(folders) - 1; i >= 0; i-- {
+		os.Remove(folders[i]) //fails on folders that are not empty
+	}
+	return nil
+}
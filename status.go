@@ -0,0 +1,117 @@
+package chunk
+
+import (
+	"strconv"
+)
+
+// SessionStatus - what a client needs to resume an upload session
+type SessionStatus struct {
+	Identifier string
+	//Manifest - nil until the first chunk arrives, or when the destination cannot read it back
+	Manifest *SessionManifest
+	//Received - chunk numbers stored, in order
+	Received []int
+	//Missing - chunk numbers still to upload, known once the manifest holds TotalChunks
+	Missing []ChunkRange
+	//ReceivedBytes - the sum of the stored chunk sizes
+	ReceivedBytes int64
+	//Complete - every byte of the manifest's TotalSize is stored
+	Complete bool
+	//Assembly - left at AssemblyUnknown by ChunkUpload.Status, see FileAssembler.Status
+	Assembly AssemblyStatus
+}
+
+// ChunkRange - the chunk numbers First to Last, both included
+type ChunkRange struct {
+	First int
+	Last  int
+}
+
+// Status - the chunks stored so far for the session Identifier, computed from Destination
+func (u *ChunkUpload) Status() (*SessionStatus, error) {
+	d := u.Destination.Writer(u.chunkFolderName())
+	status := &SessionStatus{Identifier: u.Identifier}
+
+	manifest, err := readManifest(d)
+	if err != nil {
+		return nil, err
+	}
+	status.Manifest = manifest
+
+	files, err := u.Destination.Reader(u.chunkFolderName()).Files()
+	if err != nil {
+		if manifest == nil && d.Size(manifestFilename) < 0 {
+			return status, nil //no session, or it is already assembled
+		}
+		return nil, err
+	}
+
+	received := make(map[int]bool, len(files))
+	for _, f := range files {
+		n, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		received[n] = true
+		status.Received = append(status.Received, n)
+		status.ReceivedBytes += f.Size()
+	}
+
+	if manifest != nil {
+		status.Missing = missingRanges(received, manifest.TotalChunks)
+		status.Complete = status.ReceivedBytes == manifest.TotalSize
+	}
+	return status, nil
+}
+
+// missingRanges - the runs of chunk numbers from 1 to total that were not received
+func missingRanges(received map[int]bool, total int) []ChunkRange {
+	var missing []ChunkRange
+	for n := 1; n <= total; n++ {
+		if received[n] {
+			continue
+		}
+		if last := len(missing) - 1; last >= 0 && missing[last].Last == n-1 {
+			missing[last].Last = n
+		} else {
+			missing = append(missing, ChunkRange{First: n, Last: n})
+		}
+	}
+	return missing
+}
+
+////////////////////////////
+
+// AssemblyState - where a session is in the FileAssembler
+type AssemblyState int
+
+const (
+	// AssemblyUnknown - never posted, or finished too long ago to be remembered
+	AssemblyUnknown AssemblyState = iota
+	AssemblyQueued
+	AssemblyRunning
+	AssemblyDone
+	AssemblyFailed
+	AssemblyCancelled
+)
+
+var assemblyStates = []string{"unknown", "queued", "running", "done", "failed", "cancelled"}
+
+func (s AssemblyState) String() string {
+	if s < 0 || int(s) >= len(assemblyStates) {
+		return "unknown"
+	}
+	return assemblyStates[s]
+}
+
+// MarshalText - states are written by name in JSON
+func (s AssemblyState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// AssemblyStatus - the state of an assembly, with the outcome once it finished
+type AssemblyStatus struct {
+	State AssemblyState
+	Uri   string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
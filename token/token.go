@@ -0,0 +1,127 @@
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/fw/me"
+)
+
+var (
+	// ErrInvalidToken - malformed or not signed with the secret
+	ErrInvalidToken = errors.New("invalid upload token")
+	// ErrTokenExpired - the grant's Expires has passed
+	ErrTokenExpired = errors.New("upload token expired")
+)
+
+// Grant - what the holder of a token may upload. The API server signs it with a secret shared with the upload
+// servers, the client sends the token with every chunk and flow.Handler verifies it without calling back.
+type Grant struct {
+	// Identifier - the flowIdentifier of the only session the token covers
+	Identifier string `json:"id"`
+	// Tenant - the user or tenant the session is namespaced by, see flow.Handler.Identity
+	Tenant string `json:"tenant,omitempty"`
+	// MaxSize - largest flowTotalSize allowed, zero for no limit
+	MaxSize int64 `json:"max,omitempty"`
+	// ContentTypes - allowed media types of the file, "image/*" allows a family, empty allows any
+	ContentTypes []string `json:"types,omitempty"`
+	// Destination - where the assembled file goes, interpreted by the application
+	Destination string `json:"dest,omitempty"`
+	// Expires - the token is refused after this time
+	Expires time.Time `json:"exp"`
+}
+
+// Allows - an error if the chunk is outside the grant. contentType is the media type detected from the
+// content and is ignored when empty, before the first chunk is read pass "" and check ContentTypes with
+// chunk.FileTypes.Restrict instead. A type declared by the client proves nothing.
+func (g *Grant) Allows(u *chunk.ChunkUpload, contentType string) error {
+	if u.Identifier != g.Identifier {
+		return me.NewErr("upload token is for another identifier", &me.KV{"identifier", u.Identifier})
+	}
+	if g.Tenant != "" && u.Tenant != g.Tenant {
+		return me.NewErr("upload token is for another tenant", &me.KV{"tenant", u.Tenant})
+	}
+	if g.MaxSize > 0 && u.TotalSize > g.MaxSize {
+		return me.NewErr("upload larger than the token allows", &me.KV{"totalSize", u.TotalSize}, &me.KV{"maxSize", g.MaxSize})
+	}
+	if contentType == "" || len(g.ContentTypes) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !chunk.MatchMediaType(g.ContentTypes, strings.ToLower(mediaType)) {
+		return me.NewErr("content type not allowed by the upload token", &me.KV{"contentType", contentType})
+	}
+	return nil
+}
+
+// Signer - signs and verifies grants with HMAC-SHA256. A token is the base64url JSON of the grant, a dot
+// and the base64url signature of that.
+type Signer struct {
+	Secret []byte
+	// Now - the clock expiry is checked against, defaults to time.Now
+	Now func() time.Time
+}
+
+func (s *Signer) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// Sign - the token for g
+func (s *Signer) Sign(g *Grant) (string, error) {
+	if len(s.Secret) == 0 {
+		return "", me.NewErr("no secret to sign upload tokens with")
+	}
+	if g.Identifier == "" || g.Expires.IsZero() {
+		return "", me.NewErr("upload grant needs an identifier and an expiry")
+	}
+
+	b, err := json.Marshal(g)
+	if err != nil {
+		return "", me.Err(err, "failed to encode upload grant")
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload)), nil
+}
+
+// Verify - the grant of a token signed with Secret that has not expired
+func (s *Signer) Verify(token string) (*Grant, error) {
+	dot := strings.IndexByte(token, '.')
+	if len(s.Secret) == 0 || dot < 0 {
+		return nil, ErrInvalidToken
+	}
+	payload := token[:dot]
+	sig, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil || !hmac.Equal(sig, s.mac(payload)) {
+		return nil, ErrInvalidToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	g := new(Grant)
+	if err = json.Unmarshal(b, g); err != nil || g.Identifier == "" {
+		return nil, ErrInvalidToken
+	}
+	if !s.now().Before(g.Expires) {
+		return nil, ErrTokenExpired
+	}
+	return g, nil
+}
+
+func (s *Signer) mac(payload string) []byte {
+	m := hmac.New(sha256.New, s.Secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
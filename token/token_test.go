@@ -0,0 +1,62 @@
+package token_test
+
+import (
+	"time"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/token"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signer", func() {
+	var signer *Signer
+	var grant *Grant
+
+	BeforeEach(func() {
+		signer = &Signer{Secret: []byte("shared secret")}
+		grant = &Grant{
+			Identifier:   "1024-photojpg",
+			MaxSize:      1 << 20,
+			ContentTypes: []string{"image/*"},
+			Destination:  "images",
+			Expires:      time.Now().Add(time.Hour),
+		}
+	})
+
+	It("should verify its own tokens", func() {
+		t, err := signer.Sign(grant)
+		Expect(err).To(BeNil())
+
+		verified, err := signer.Verify(t)
+		Expect(err).To(BeNil())
+		Expect(verified.Identifier).To(Equal(grant.Identifier))
+		Expect(verified.Destination).To(Equal("images"))
+	})
+
+	It("should refuse tampered, foreign and expired tokens", func() {
+		t, _ := signer.Sign(grant)
+		other, _ := (&Signer{Secret: []byte("other secret")}).Sign(grant)
+
+		_, err := signer.Verify("x" + t)
+		Expect(err).To(Equal(ErrInvalidToken))
+		_, err = signer.Verify(other)
+		Expect(err).To(Equal(ErrInvalidToken))
+
+		signer.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		_, err = signer.Verify(t)
+		Expect(err).To(Equal(ErrTokenExpired))
+	})
+
+	It("should only allow uploads inside the grant", func() {
+		u := &chunk.ChunkUpload{Identifier: grant.Identifier, TotalSize: 1000}
+		Expect(grant.Allows(u, "image/jpeg")).To(BeNil())
+		Expect(grant.Allows(u, "application/x-msdownload")).NotTo(BeNil())
+
+		u.TotalSize = 2 << 20
+		Expect(grant.Allows(u, "image/jpeg")).NotTo(BeNil())
+		u.TotalSize, u.Identifier = 1000, "another"
+		Expect(grant.Allows(u, "image/jpeg")).NotTo(BeNil())
+	})
+})
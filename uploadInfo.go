@@ -0,0 +1,119 @@
+package chunk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gotgo/fw/me"
+)
+
+// sniffSize - bytes DetectContentType looks at
+const sniffSize = 512
+
+// UploadInfo - what is known about a file before it is assembled, used to name and route it
+type UploadInfo struct {
+	Identifier string
+	Tenant     string
+	//Filename - the original filename on the client
+	Filename     string
+	RelativePath string
+	//Size - sum of the chunk sizes
+	Size int64
+	//ContentType - detected from the first bytes of the file
+	ContentType string
+	//Data - AssembleFolder.Data
+	Data interface{}
+
+	source *ChunkFolder
+	digest string
+}
+
+func newUploadInfo(a *AssembleFolder) (*UploadInfo, error) {
+	source := a.Source
+	info := &UploadInfo{
+		Identifier:   source.Identifier,
+		Tenant:       source.Tenant,
+		Filename:     source.OriginalFilename,
+		RelativePath: source.RelativePath,
+		Data:         a.Data,
+		source:       source,
+	}
+
+	files, err := source.Files()
+	if err != nil {
+		return nil, me.Err(err, "failed to list chunks", &me.KV{"identifier", source.Identifier})
+	}
+	if info.Size, err = sumSizes(files, nil); err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		if info.ContentType, err = sniff(files[0]); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// defaultName - the name used by NameByIdentifier
+func (i *UploadInfo) defaultName() string {
+	if i.source != nil && i.source.Filename != "" {
+		return i.source.Filename
+	}
+	return i.Identifier
+}
+
+// Ext - the lower case extension of Filename, including the dot
+func (i *UploadInfo) Ext() string {
+	return strings.ToLower(path.Ext(SanitizeFilename(i.Filename)))
+}
+
+// MediaType - ContentType without parameters, "text/plain" for "text/plain; charset=utf-8"
+func (i *UploadInfo) MediaType() string {
+	return mediaType(i.ContentType)
+}
+
+// Sha256 - hex encoded sha256 of the file, computed from the chunks on first use
+func (i *UploadInfo) Sha256() (string, error) {
+	if i.digest != "" || i.source == nil {
+		return i.digest, nil
+	}
+
+	files, err := i.source.Files()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		src, err := file.Open()
+		if err != nil {
+			return "", me.Err(err, "Failed to open file", &me.KV{"file", file.Uri()})
+		}
+		_, err = io.Copy(h, src)
+		src.Close()
+		if err != nil {
+			return "", me.Err(err, "failed to hash chunk", &me.KV{"file", file.Uri()})
+		}
+	}
+	i.digest = hex.EncodeToString(h.Sum(nil))
+	return i.digest, nil
+}
+
+// sniff - content type of the first bytes of file
+func sniff(file FileSource) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", me.Err(err, "Failed to open file", &me.KV{"file", file.Uri()})
+	}
+	defer src.Close()
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", me.Err(err, "failed to read start of file", &me.KV{"file", file.Uri()})
+	}
+	return DetectContentType(head[:n]), nil
+}
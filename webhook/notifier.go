@@ -0,0 +1,360 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/fw/logging"
+	"github.com/gotgo/fw/me"
+)
+
+const (
+	// SignatureHeader - hex encoded HMAC-SHA256 of the request body, prefixed with "sha256="
+	SignatureHeader = "X-Chunk-Signature"
+	// DeliveryHeader - unique per notification, repeated on every retry so receivers can deduplicate
+	DeliveryHeader = "X-Chunk-Delivery"
+
+	defaultMaxAttempts = 10
+	defaultBackoff     = time.Second
+	defaultMaxBackoff  = 10 * time.Minute
+	defaultTimeout     = 30 * time.Second
+)
+
+// Payload - the JSON body POSTed for every completed upload
+type Payload struct {
+	Uri      string      `json:"uri"`
+	Size     int64       `json:"size"`
+	Digest   string      `json:"digest"`
+	Filename string      `json:"filename"`
+	Error    string      `json:"error,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	// Metadata - added by the processors of the assembler's pipeline
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Derived - uris of the files the processors wrote
+	Derived []string `json:"derived,omitempty"`
+}
+
+// Notifier - POSTs every UploadOutcome as JSON to each of URLs, retrying with exponential backoff.
+// Pending notifications are kept in the outbox, so with OutboxFolder set they survive restarts.
+// Every URL is delivered to on its own, oldest notification first, so a slow or dead receiver does not
+// hold up the others. Use Notify as AssembleFolder.Callback.
+type Notifier struct {
+	Log logging.Logger `inject:""`
+
+	URLs []string
+	// Secret - key for the HMAC-SHA256 signature in SignatureHeader, unsigned when empty
+	Secret []byte
+	// OutboxFolder - where pending notifications are persisted, memory only when empty
+	OutboxFolder string
+	// MaxAttempts - deliveries to try before giving up, defaults to 10
+	MaxAttempts int
+	// Backoff - wait after the first failure, doubled after each further failure. Defaults to one second
+	Backoff time.Duration
+	// MaxBackoff - upper bound of the wait between attempts, defaults to 10 minutes
+	MaxBackoff time.Duration
+	// Client - defaults to a client with a 30 second timeout
+	Client *http.Client
+
+	outbox  *outbox
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	running bool
+	mu      sync.Mutex
+	//lastCreated - of the latest notification, guarded by mu
+	lastCreated time.Time
+
+	//cancel - aborts the requests in flight on Stop
+	cancel context.CancelFunc
+	ctx    context.Context
+	//busy - URLs a delivery is running for, guarded by busyMu
+	busy    map[string]bool
+	busyMu  sync.Mutex
+	workers sync.WaitGroup
+}
+
+// Start - load the outbox and begin delivering
+func (n *Notifier) Start() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.running {
+		return nil
+	}
+
+	if err := n.init(); err != nil {
+		return err
+	}
+
+	n.stop = make(chan struct{})
+	n.done = make(chan struct{})
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.busy = make(map[string]bool)
+	go n.deliver()
+	n.running = true
+	return nil
+}
+
+// Stop - stop delivering, pending notifications stay in the outbox
+func (n *Notifier) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.running {
+		return
+	}
+
+	close(n.stop)
+	n.cancel()
+	<-n.done
+	n.workers.Wait()
+	n.running = false
+}
+
+// Notify - queue the outcome for delivery to every URL
+func (n *Notifier) Notify(o *chunk.UploadOutcome) {
+	p := &Payload{
+		Uri:      o.Uri,
+		Size:     o.Size,
+		Digest:   o.Digest,
+		Filename: o.Filename,
+		Data:     o.Data,
+		Metadata: o.Metadata,
+	}
+	for _, d := range o.Derived {
+		p.Derived = append(p.Derived, d.Uri)
+	}
+	if o.Err != nil {
+		p.Error = o.Err.Error()
+	}
+
+	body, err := json.Marshal(p)
+	if err != nil {
+		me.LogError(n.Log, "failed to encode webhook payload", err, &logging.KV{"uri", o.Uri})
+		return
+	}
+
+	n.mu.Lock()
+	err = n.init()
+	//strictly increasing, so notifications keep their order on coarse clocks
+	now := time.Now()
+	if !now.After(n.lastCreated) {
+		now = n.lastCreated.Add(time.Nanosecond)
+	}
+	n.lastCreated = now
+	n.mu.Unlock()
+	if err != nil {
+		me.LogError(n.Log, "failed to open webhook outbox", err, &logging.KV{"folder", n.OutboxFolder})
+		return
+	}
+
+	for _, url := range n.URLs {
+		e := &entry{ID: newID(), URL: url, Body: body, Created: now, Next: now}
+		if err := n.outbox.add(e); err != nil {
+			me.LogError(n.Log, "failed to persist webhook notification", err, &logging.KV{"url", url})
+		}
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// init - called with mu held
+func (n *Notifier) init() error {
+	if n.outbox != nil {
+		return nil
+	}
+
+	o := &outbox{folder: n.OutboxFolder}
+	if err := o.load(); err != nil {
+		return err
+	}
+	n.outbox = o
+	n.wake = make(chan struct{}, 1)
+	return nil
+}
+
+func (n *Notifier) deliver() {
+	defer close(n.done)
+	for {
+		wait := n.deliverDue()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-n.stop:
+			timer.Stop()
+			return
+		case <-n.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// deliverDue - start delivering the due entries of every URL no delivery is running for, returns the wait
+// until the next one is due
+func (n *Notifier) deliverDue() time.Duration {
+	busy := n.busyURLs()
+	byURL := make(map[string][]*entry)
+	for _, e := range n.outbox.due(time.Now(), busy) {
+		byURL[e.URL] = append(byURL[e.URL], e)
+	}
+
+	n.busyMu.Lock()
+	for url, entries := range byURL {
+		n.busy[url] = true
+		busy[url] = true
+		n.workers.Add(1)
+		go n.deliverTo(url, entries)
+	}
+	n.busyMu.Unlock()
+	return n.outbox.nextDue(time.Now(), defaultMaxBackoff, busy)
+}
+
+func (n *Notifier) busyURLs() map[string]bool {
+	n.busyMu.Lock()
+	defer n.busyMu.Unlock()
+	busy := make(map[string]bool, len(n.busy))
+	for url := range n.busy {
+		busy[url] = true
+	}
+	return busy
+}
+
+// deliverTo - try the entries of one URL in order, up to the first that has to be retried, then wake the
+// delivery loop for what became due meanwhile
+func (n *Notifier) deliverTo(url string, entries []*entry) {
+	defer n.workers.Done()
+	defer func() {
+		n.busyMu.Lock()
+		delete(n.busy, url)
+		n.busyMu.Unlock()
+		select {
+		case n.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	for _, e := range entries {
+		if n.ctx.Err() != nil {
+			return
+		}
+		if !n.attempt(e) {
+			return //the later entries wait for it
+		}
+	}
+}
+
+// attempt - post e once, removing it when delivered and scheduling or failing it otherwise. False if e
+// stays in the outbox.
+func (n *Notifier) attempt(e *entry) bool {
+	err := n.post(e)
+	if err == nil {
+		if err = n.outbox.remove(e); err != nil {
+			me.LogError(n.Log, "failed to remove delivered webhook notification", err, &logging.KV{"id", e.ID})
+		}
+		return true
+	}
+	if n.ctx.Err() != nil {
+		return false //stopped, the attempt does not count
+	}
+
+	e.Attempts++
+	if e.Attempts >= n.maxAttempts() {
+		me.LogError(n.Log, "webhook notification failed, giving up", err, &logging.KV{"url", e.URL}, &logging.KV{"id", e.ID})
+		if err = n.outbox.fail(e); err != nil {
+			me.LogError(n.Log, "failed to move webhook notification out of the outbox", err, &logging.KV{"id", e.ID})
+		}
+		return true
+	}
+
+	e.Next = time.Now().Add(n.backoff(e.Attempts))
+	if err = n.outbox.update(e); err != nil {
+		me.LogError(n.Log, "failed to persist webhook notification", err, &logging.KV{"id", e.ID})
+	}
+	return false
+}
+
+func (n *Notifier) post(e *entry) error {
+	req, err := http.NewRequestWithContext(n.ctx, "POST", e.URL, bytes.NewReader(e.Body))
+	if err != nil {
+		return me.Err(err, "failed to create webhook request", &me.KV{"url", e.URL})
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, e.ID)
+	if len(n.Secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(n.Secret, e.Body))
+	}
+
+	resp, err := n.client().Do(req)
+	if err != nil {
+		return me.Err(err, "webhook request failed", &me.KV{"url", e.URL})
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return me.NewErr("webhook rejected", &me.KV{"url", e.URL}, &me.KV{"status", resp.StatusCode})
+	}
+	return nil
+}
+
+func (n *Notifier) client() *http.Client {
+	if n.Client != nil {
+		return n.Client
+	}
+	return &http.Client{Timeout: defaultTimeout}
+}
+
+func (n *Notifier) maxAttempts() int {
+	if n.MaxAttempts > 0 {
+		return n.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+// backoff - wait before the next attempt, after attempts failures
+func (n *Notifier) backoff(attempts int) time.Duration {
+	wait, max := n.Backoff, n.MaxBackoff
+	if wait <= 0 {
+		wait = defaultBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// Sign - the SignatureHeader value for body
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify - true if signature is the SignatureHeader value of body, for use by receivers
+func Verify(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to read random bytes")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,149 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gotgo/chunk"
+	. "github.com/gotgo/chunk/webhook"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Receiver - records signed deliveries, failing the first failures requests
+type Receiver struct {
+	secret   []byte
+	failures int
+	mu       sync.Mutex
+	attempts int
+	payloads []*Payload
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		w.WriteHeader(503)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	if !Verify(r.secret, body, req.Header.Get(SignatureHeader)) {
+		w.WriteHeader(401)
+		return
+	}
+	p := new(Payload)
+	json.Unmarshal(body, p)
+	r.payloads = append(r.payloads, p)
+}
+
+func (r *Receiver) received() []*Payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Payload(nil), r.payloads...)
+}
+
+var _ = Describe("Notifier", func() {
+	secret := []byte("secret")
+	outcome := &chunk.UploadOutcome{Uri: "/tmp/complete/abc", Size: 1024, Digest: "ff", Filename: "photo.jpg",
+		Metadata: map[string]interface{}{"width": 640}, Derived: []chunk.Derived{{Stage: "thumbnail", Name: "abc.small", Uri: "/tmp/complete/abc.small"}}}
+
+	It("should retry until the receiver accepts", func() {
+		r := &Receiver{secret: secret, failures: 2}
+		server := httptest.NewServer(r)
+		defer server.Close()
+
+		n := &Notifier{URLs: []string{server.URL}, Secret: secret, Backoff: 10 * time.Millisecond}
+		Expect(n.Start()).To(BeNil())
+		defer n.Stop()
+
+		n.Notify(outcome)
+		Eventually(r.received).Should(HaveLen(1))
+		p := r.received()[0]
+		Expect(p.Uri).To(Equal(outcome.Uri))
+		Expect(p.Size).To(Equal(outcome.Size))
+		Expect(p.Filename).To(Equal(outcome.Filename))
+		Expect(p.Metadata).To(HaveKeyWithValue("width", 640.0))
+		Expect(p.Derived).To(Equal([]string{"/tmp/complete/abc.small"}))
+	})
+
+	It("should deliver notifications left in the outbox", func() {
+		folder, err := ioutil.TempDir("", "outbox")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(folder)
+
+		r := &Receiver{secret: secret}
+		server := httptest.NewServer(r)
+		defer server.Close()
+
+		//never started, as if the process died before delivering
+		first := &Notifier{URLs: []string{server.URL}, Secret: secret, OutboxFolder: folder}
+		first.Notify(outcome)
+		Consistently(r.received, 50*time.Millisecond).Should(BeEmpty())
+
+		second := &Notifier{URLs: []string{server.URL}, Secret: secret, OutboxFolder: folder}
+		Expect(second.Start()).To(BeNil())
+		defer second.Stop()
+
+		Eventually(r.received).Should(HaveLen(1))
+		Eventually(func() int {
+			files, _ := ioutil.ReadDir(folder)
+			return len(files)
+		}).Should(Equal(0))
+	})
+
+	It("should deliver to every URL on its own, oldest first", func() {
+		hung := make(chan struct{})
+		dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-hung
+		}))
+		defer dead.Close()
+		defer close(hung)
+
+		r := &Receiver{secret: secret}
+		server := httptest.NewServer(r)
+		defer server.Close()
+
+		n := &Notifier{URLs: []string{dead.URL, server.URL}, Secret: secret, Client: &http.Client{Timeout: time.Minute}}
+		Expect(n.Start()).To(BeNil())
+		defer n.Stop()
+
+		for _, name := range []string{"a", "b", "c"} {
+			n.Notify(&chunk.UploadOutcome{Filename: name})
+		}
+		Eventually(r.received, time.Second).Should(HaveLen(3))
+		var names []string
+		for _, p := range r.received() {
+			names = append(names, p.Filename)
+		}
+		Expect(names).To(Equal([]string{"a", "b", "c"}))
+	})
+
+	It("should hold back later notifications while one is retried", func() {
+		r := &Receiver{secret: secret, failures: 1}
+		server := httptest.NewServer(r)
+		defer server.Close()
+
+		n := &Notifier{URLs: []string{server.URL}, Secret: secret, Backoff: 20 * time.Millisecond}
+		for _, name := range []string{"a", "b", "c"} {
+			n.Notify(&chunk.UploadOutcome{Filename: name})
+		}
+		Expect(n.Start()).To(BeNil())
+		defer n.Stop()
+
+		Eventually(r.received, time.Second).Should(HaveLen(3))
+		var names []string
+		for _, p := range r.received() {
+			names = append(names, p.Filename)
+		}
+		Expect(names).To(Equal([]string{"a", "b", "c"}))
+	})
+
+})
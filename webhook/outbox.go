@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gotgo/chunk"
+	"github.com/gotgo/fw/me"
+)
+
+const entryExt = ".json"
+const failedFolder = "failed"
+
+// entry - one notification for one URL
+type entry struct {
+	ID       string
+	URL      string
+	Body     json.RawMessage
+	Attempts int
+	Created  time.Time
+	Next     time.Time
+}
+
+// outbox - pending entries, mirrored to one file per entry when folder is set
+type outbox struct {
+	folder  string
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func (o *outbox) load() error {
+	o.entries = make(map[string]*entry)
+	if o.folder == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(o.folder, 0774); err != nil {
+		return me.Err(err, "failed to create outbox folder", &me.KV{"folder", o.folder})
+	}
+
+	fileInfos, err := ioutil.ReadDir(o.folder)
+	if err != nil {
+		return me.Err(err, "failed to read outbox folder", &me.KV{"folder", o.folder})
+	}
+
+	for _, fi := range fileInfos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), entryExt) {
+			continue
+		}
+		filePath := filepath.Join(o.folder, fi.Name())
+		b, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return me.Err(err, "failed to read outbox entry", &me.KV{"file", filePath})
+		}
+		e := new(entry)
+		if err = json.Unmarshal(b, e); err != nil {
+			//a torn write from a crash, nothing to deliver
+			os.Remove(filePath)
+			continue
+		}
+		o.entries[e.ID] = e
+	}
+	return nil
+}
+
+// add - persisted before it is visible to the delivery loop, kept in memory even if persisting fails
+func (o *outbox) add(e *entry) error {
+	err := o.persist(e)
+	o.mu.Lock()
+	o.entries[e.ID] = e
+	o.mu.Unlock()
+	return err
+}
+
+func (o *outbox) update(e *entry) error {
+	return o.persist(e)
+}
+
+func (o *outbox) remove(e *entry) error {
+	o.mu.Lock()
+	delete(o.entries, e.ID)
+	o.mu.Unlock()
+	if o.folder == "" {
+		return nil
+	}
+	return os.Remove(o.path(e))
+}
+
+// fail - drop e from the outbox, keeping its file in the failed folder for inspection
+func (o *outbox) fail(e *entry) error {
+	o.mu.Lock()
+	delete(o.entries, e.ID)
+	o.mu.Unlock()
+	if o.folder == "" {
+		return nil
+	}
+
+	failed := filepath.Join(o.folder, failedFolder)
+	if err := os.MkdirAll(failed, 0774); err != nil {
+		return err
+	}
+	return os.Rename(o.path(e), filepath.Join(failed, e.ID+entryExt))
+}
+
+// due - entries to try now, oldest first, skipping the URLs in busy. An entry waiting for its retry holds
+// back the later ones of its URL, so they are delivered in order.
+func (o *outbox) due(now time.Time, busy map[string]bool) []*entry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var due []*entry
+	waiting := make(map[string]bool)
+	for _, e := range o.pending(busy) {
+		if waiting[e.URL] {
+			continue
+		}
+		if e.Next.After(now) {
+			waiting[e.URL] = true
+			continue
+		}
+		due = append(due, e)
+	}
+	return due
+}
+
+// nextDue - wait until the oldest entry of a URL that is not busy is due, at most max
+func (o *outbox) nextDue(now time.Time, max time.Duration, busy map[string]bool) time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	wait := max
+	oldest := make(map[string]bool)
+	for _, e := range o.pending(busy) {
+		if oldest[e.URL] {
+			continue
+		}
+		oldest[e.URL] = true
+		if d := e.Next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// pending - the entries of the URLs not in busy, oldest first, called with mu held. The delivery of a busy
+// URL reads and writes its entries.
+func (o *outbox) pending(busy map[string]bool) []*entry {
+	var pending []*entry
+	for _, e := range o.entries {
+		if !busy[e.URL] {
+			pending = append(pending, e)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].Created.Equal(pending[j].Created) {
+			return pending[i].Created.Before(pending[j].Created)
+		}
+		return pending[i].ID < pending[j].ID
+	})
+	return pending
+}
+
+// persist - replace the file of e atomically, so a crash never leaves a partial or lost entry behind
+func (o *outbox) persist(e *entry) error {
+	if o.folder == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err = chunk.WriteFileAtomic(o.path(e), b); err != nil {
+		return me.Err(err, "failed to write outbox entry", &me.KV{"file", o.path(e)})
+	}
+	return nil
+}
+
+func (o *outbox) path(e *entry) string {
+	return filepath.Join(o.folder, e.ID+entryExt)
+}